@@ -1,18 +1,58 @@
 package app
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
+	"net/http"
 	"net/url"
+	"os"
 	"path"
-	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/abel1502/mipt-kp-m-test/internal/azure"
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
 	"github.com/abel1502/mipt-kp-m-test/internal/backup"
+	"github.com/abel1502/mipt-kp-m-test/internal/chunker"
 	"github.com/abel1502/mipt-kp-m-test/internal/fail"
 	"github.com/gobwas/glob"
 	"github.com/spf13/cobra"
 )
 
 var argDirectory string
+var argPasswordFile string
+var argKeyFile string
+
+// passwordEnvVar is the environment variable consulted for the repository passphrase
+const passwordEnvVar = "BACKUP_PASSWORD"
+
+// servePasswordEnvVar is the environment variable holding the password for the serve command
+const servePasswordEnvVar = "BACKUP_SERVE_PASSWORD"
+
+const (
+	// ExitFailure is the exit code for any error
+	ExitFailure = 1
+	// ExitPartial is the exit code for a backup that saved a partial snapshot
+	ExitPartial = 3
+)
+
+// ExitCode picks the process exit code for an error returned by a command
+func ExitCode(err error) int {
+	if errors.Is(err, fail.ErrPartialBackup) {
+		return ExitPartial
+	}
+
+	return ExitFailure
+}
 
 func MakeCmdRoot(appName string) *cobra.Command {
 	rootCmd := &cobra.Command{
@@ -24,18 +64,92 @@ func MakeCmdRoot(appName string) *cobra.Command {
 		},
 	}
 
-	rootCmd.PersistentFlags().StringVarP(&argDirectory, "directory", "C", ".", "Working directory")
+	rootCmd.PersistentFlags().StringVarP(&argDirectory, "directory", "C", ".", "Working directory, or a backend URL (s3://, azure+https://, sftp://, rest+https://)")
+	rootCmd.PersistentFlags().StringVar(&argPasswordFile, "password-file", "", "File containing the repository passphrase (also see $"+passwordEnvVar+")")
+	rootCmd.PersistentFlags().StringVar(&argKeyFile, "key-file", "", "Key file protecting the repository (generated by init if missing)")
 
+	defaultChunking := chunker.DefaultParams()
+	CmdInit.PersistentFlags().StringVar((*string)(&argInitChunking.Algorithm), "chunker", string(defaultChunking.Algorithm), "Content-defined chunking algorithm (none, rabin, fastcdc, buzhash)")
+	CmdInit.PersistentFlags().Uint32Var(&argInitChunking.MinSize, "chunk-min", defaultChunking.MinSize, "Minimum chunk size in bytes")
+	CmdInit.PersistentFlags().Uint32Var(&argInitChunking.AvgSize, "chunk-avg", defaultChunking.AvgSize, "Average chunk size in bytes")
+	CmdInit.PersistentFlags().Uint32Var(&argInitChunking.MaxSize, "chunk-max", defaultChunking.MaxSize, "Maximum chunk size in bytes")
+	CmdInit.PersistentFlags().StringVar((*string)(&argInitContentHash), "hash", string(backup.ContentHashSHA256), "Content hash addressing unencrypted data (sha256, blake3)")
+	CmdInit.PersistentFlags().StringVar((*string)(&argInitCompression), "compression", string(backup.CompressionZstd), "Compression algorithm for stored data (none, zstd, lz4)")
 	rootCmd.AddCommand(CmdInit)
 
+	CmdBackup.PersistentFlags().StringSliceVar(&argBackupTags, "tag", nil, "Tag to attach to the new snapshot (may be repeated)")
+	CmdBackup.PersistentFlags().IntVarP(&argBackupParallel, "parallel", "j", 4, "Number of blobs to back up concurrently")
+	CmdBackup.PersistentFlags().IntVar(&argBackupParallelRanges, "parallel-ranges", 8, "Total number of concurrent range downloads")
+	CmdBackup.PersistentFlags().StringVar((*string)(&argBackupConsistency), "consistency", string(backup.ConsistencyDetect), "What to do about blobs modified during the snapshot: none, detect or retry")
+	CmdBackup.PersistentFlags().IntVar(&argBackupConsistencyRetries, "consistency-retries", 3, "Number of re-snapshot rounds for --consistency=retry")
+	CmdBackup.PersistentFlags().BoolVar(&argBackupLease, "lease", false, "Lease each blob while backing it up, protecting it from modification and deletion")
+	CmdBackup.PersistentFlags().BoolVar(&argBackupTolerant, "tolerant", false, "Save a partial snapshot if some blobs fail to back up (exits with code "+strconv.Itoa(ExitPartial)+")")
+	CmdBackup.PersistentFlags().BoolVar(&argBackupCarryForward, "carry-forward", false, "Include the previous revisions of the failed blobs in a partial snapshot")
+	CmdBackup.PersistentFlags().IntVar(&argBackupParallelSnapshots, "parallel-snapshots", 32, "Number of online blob snapshots to create concurrently")
+	CmdBackup.PersistentFlags().BoolVar(&argBackupResume, "resume", false, "Resume an interrupted backup")
+	CmdBackup.PersistentFlags().BoolVar(&argBackupAbort, "abort", false, "Discard an interrupted backup and its online snapshots")
+	CmdBackup.MarkFlagsMutuallyExclusive("resume", "abort")
 	rootCmd.AddCommand(CmdBackup)
 
+	rootCmd.AddCommand(CmdStats)
+
+	CmdGC.PersistentFlags().BoolVarP(&argGCDryRun, "dry-run", "n", false, "Only report what would be removed")
+	CmdGC.PersistentFlags().BoolVar(&argGCQuarantine, "quarantine", false, "Move unreferenced data into the quarantine directory instead of deleting it")
+	rootCmd.AddCommand(CmdGC)
+
+	CmdForget.PersistentFlags().IntVar(&argForgetPolicy.Last, "keep-last", 0, "Keep the N most recent snapshots")
+	CmdForget.PersistentFlags().IntVar(&argForgetPolicy.Hourly, "keep-hourly", 0, "Keep the last snapshot of each of the N most recent hours")
+	CmdForget.PersistentFlags().IntVar(&argForgetPolicy.Daily, "keep-daily", 0, "Keep the last snapshot of each of the N most recent days")
+	CmdForget.PersistentFlags().IntVar(&argForgetPolicy.Weekly, "keep-weekly", 0, "Keep the last snapshot of each of the N most recent weeks")
+	CmdForget.PersistentFlags().IntVar(&argForgetPolicy.Monthly, "keep-monthly", 0, "Keep the last snapshot of each of the N most recent months")
+	CmdForget.PersistentFlags().IntVar(&argForgetPolicy.Yearly, "keep-yearly", 0, "Keep the last snapshot of each of the N most recent years")
+	CmdForget.PersistentFlags().StringVar(&argForgetWithin, "keep-within", "", "Keep snapshots taken within this duration of the latest one (e.g. 36h, 14d)")
+	CmdForget.PersistentFlags().StringSliceVar(&argForgetPolicy.Tags, "keep-tag", nil, "Keep snapshots with this tag (may be repeated)")
+	CmdForget.PersistentFlags().BoolVarP(&argForgetDryRun, "dry-run", "n", false, "Only show which snapshots would be removed")
+	CmdForget.PersistentFlags().BoolVar(&argForgetPrune, "prune", false, "Remove the data that is no longer referenced afterwards")
+	rootCmd.AddCommand(CmdForget)
+
 	CmdExport.PersistentFlags().BoolVarP(&argExportFlat, "flat", "f", false, "Ignore original subdirectories for output files")
+	addSnapshotFlags(CmdExport)
 	rootCmd.AddCommand(CmdExport)
 
+	CmdSnapshots.PersistentFlags().BoolVar(&argJSON, "json", false, "Print the listing as JSON")
+	rootCmd.AddCommand(CmdSnapshots)
+
+	CmdLs.PersistentFlags().BoolVar(&argJSON, "json", false, "Print the listing as JSON")
+	addSnapshotFlags(CmdLs)
+	rootCmd.AddCommand(CmdLs)
+
+	CmdDiff.PersistentFlags().BoolVar(&argJSON, "json", false, "Print the differences as JSON")
+	rootCmd.AddCommand(CmdDiff)
+
+	CmdCheck.PersistentFlags().BoolVar(&argCheckOptions.ReadData, "read-data", false, "Read back all data and verify the hashes")
+	CmdCheck.PersistentFlags().Float64Var(&argCheckOptions.ReadDataSubset, "read-data-subset", 0, "Read back a random percentage of the data")
+	CmdCheck.PersistentFlags().BoolVar(&argJSON, "json", false, "Print the report as JSON")
+	rootCmd.AddCommand(CmdCheck)
+
+	CmdUnlock.PersistentFlags().BoolVar(&argUnlockRemoveAll, "remove-all", false, "Remove all locks, even the ones held by live processes")
+	rootCmd.AddCommand(CmdUnlock)
+
+	CmdRestore.PersistentFlags().BoolVar(&argRestoreOverwrite, "overwrite", false, "Overwrite blobs that already exist in the target container (skipped by default)")
+	addSnapshotFlags(CmdRestore)
+	rootCmd.AddCommand(CmdRestore)
+
+	CmdServe.PersistentFlags().StringVar(&argServeListen, "listen", "localhost:8000", "Address to listen on")
+	CmdServe.PersistentFlags().BoolVar(&argServeAppendOnly, "append-only", false, "Forbid deleting or changing the stored data")
+	CmdServe.PersistentFlags().StringVar(&argServeUser, "user", "", "Require basic authentication as this user, with the password from $"+servePasswordEnvVar)
+	CmdServe.PersistentFlags().StringVar(&argServeTLSCert, "tls-cert", "", "TLS certificate file, enables HTTPS together with --tls-key")
+	CmdServe.PersistentFlags().StringVar(&argServeTLSKey, "tls-key", "", "TLS private key file")
+	CmdServe.MarkFlagsRequiredTogether("tls-cert", "tls-key")
+	rootCmd.AddCommand(CmdServe)
+
 	return rootCmd
 }
 
+var argInitChunking chunker.Params
+var argInitCompression backup.Compression
+var argInitContentHash backup.ContentHash
+
 var CmdInit = &cobra.Command{
 	Use:   "init container_url [directory_name]",
 	Short: "Initialize a new backup repository",
@@ -54,37 +168,94 @@ var CmdInit = &cobra.Command{
 			backupName = args[1]
 		}
 
-		directory := filepath.Join(argDirectory, backupName)
+		location := backend.Join(argDirectory, backupName)
 
-		repo, err := backup.NewRepository(containerURL, directory)
+		secret, err := readSecret(true)
 		if err != nil {
 			return err
 		}
+		if len(secret) == 0 {
+			log.Printf("Warning: No passphrase or key file provided, the repository will not be encrypted")
+		}
+
+		storage, err := backend.Open(location)
+		if err != nil {
+			return err
+		}
+
+		repo, err := backup.NewRepository(containerURL, storage, backup.RepositoryOptions{
+			Chunking:    argInitChunking,
+			Compression: argInitCompression,
+			ContentHash: argInitContentHash,
+			Secret:      secret,
+		})
+		if err != nil {
+			return errors.Join(err, storage.Close())
+		}
 
 		err = repo.Close()
 		if err != nil {
 			return err
 		}
 
-		log.Printf("Successfully initialized backup repository for %v at %v", containerURL, directory)
+		log.Printf("Successfully initialized backup repository for %v at %v", containerURL, location)
 
 		return nil
 	},
 }
 
+var argBackupTags []string
+var argBackupParallel int
+var argBackupParallelRanges int
+var argBackupParallelSnapshots int
+var argBackupConsistency backup.ConsistencyMode
+var argBackupConsistencyRetries int
+var argBackupLease bool
+var argBackupTolerant bool
+var argBackupCarryForward bool
+var argBackupResume bool
+var argBackupAbort bool
+
 var CmdBackup = &cobra.Command{
 	Use:   "backup",
 	Short: "Make a new incremental backup in the current repository",
-	Long:  "Make a new incremental backup in the current repository",
-	Args:  cobra.NoArgs,
+	Long: `Make a new incremental backup in the current repository.
+
+The online snapshots page blobs are backed up from are retained in the source container,
+so that the next backup only fetches the changed pages. While they are, deleting such a blob
+requires deleting its snapshots as well (DeleteSnapshots=include, or --delete-snapshots include with az).
+They are released once no remaining backup needs them.`,
+	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		repo, err := backup.OpenRepository(argDirectory)
+		repo, err := openRepository(backup.LockExclusive)
 		if err != nil {
 			return err
 		}
 		defer repo.Close()
 
-		err = repo.TakeSnapshot(cmd.Context())
+		if argBackupAbort {
+			err = repo.AbortBackup(cmd.Context(), argBackupParallelSnapshots)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("Discarded the interrupted backup")
+
+			return nil
+		}
+
+		err = repo.TakeSnapshot(cmd.Context(), backup.SnapshotOptions{
+			Tags:               argBackupTags,
+			Parallel:           argBackupParallel,
+			ParallelRanges:     argBackupParallelRanges,
+			ParallelSnapshots:  argBackupParallelSnapshots,
+			Consistency:        argBackupConsistency,
+			ConsistencyRetries: argBackupConsistencyRetries,
+			Lease:              argBackupLease,
+			Tolerant:           argBackupTolerant,
+			CarryForward:       argBackupCarryForward,
+			Resume:             argBackupResume,
+		})
 		if err != nil {
 			return err
 		}
@@ -95,16 +266,160 @@ var CmdBackup = &cobra.Command{
 	},
 }
 
+var CmdStats = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the space used by the current repository",
+	Long:  "Show the space used by the current repository",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := openRepository(backup.LockShared)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		stats := repo.Stats()
+
+		ratio := 1.0
+		if stats.StoredSize > 0 {
+			ratio = float64(stats.LogicalSize) / float64(stats.StoredSize)
+		}
+
+		fmt.Printf("Snapshots:    %v\n", stats.Snapshots)
+		fmt.Printf("FileBufs:     %v\n", stats.FileBufs)
+		fmt.Printf("Logical size: %v bytes\n", stats.LogicalSize)
+		fmt.Printf("Stored size:  %v bytes (%.2fx)\n", stats.StoredSize, ratio)
+
+		return nil
+	},
+}
+
+var argGCDryRun bool
+var argGCQuarantine bool
+
+var CmdGC = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove data not referenced by any snapshot",
+	Long:  "Remove data not referenced by any snapshot",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := openRepository(backup.LockExclusive)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		report, err := repo.CollectGarbage(cmd.Context(), backup.GCOptions{
+			DryRun:     argGCDryRun,
+			Quarantine: argGCQuarantine,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Referenced FileBufs:   %v\n", report.Referenced)
+		fmt.Printf("Unreferenced FileBufs: %v\n", report.Unreferenced)
+		fmt.Printf("Reclaimable:           %v bytes\n", report.ReclaimableBytes)
+		if argGCDryRun {
+			fmt.Printf("Dry run, nothing was removed\n")
+		}
+
+		return nil
+	},
+}
+
+var argForgetPolicy backup.RetentionPolicy
+var argForgetWithin string
+var argForgetDryRun bool
+var argForgetPrune bool
+
+var CmdForget = &cobra.Command{
+	Use:   "forget",
+	Short: "Remove snapshots according to a retention policy",
+	Long:  "Remove snapshots according to a retention policy",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		argForgetPolicy.Within, err = parseDays(argForgetWithin)
+		if err != nil {
+			return err
+		}
+
+		repo, err := openRepository(backup.LockExclusive)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		decisions, err := repo.Forget(cmd.Context(), argForgetPolicy, argForgetDryRun)
+		if err != nil {
+			return err
+		}
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(table, "SNAPSHOT\tTAKEN AT\tACTION\tREASONS\n")
+		forgotten := 0
+		for _, decision := range decisions {
+			action := "keep"
+			if !decision.Keep {
+				action = "remove"
+				forgotten++
+			}
+
+			fmt.Fprintf(
+				table, "%v\t%v\t%v\t%v\n",
+				decision.Snapshot.ID,
+				decision.Snapshot.SavedAt.Local().Format(time.DateTime),
+				action,
+				strings.Join(decision.Reasons, ", "),
+			)
+		}
+		table.Flush()
+
+		if argForgetDryRun {
+			fmt.Printf("Dry run: would remove %v of %v snapshot(s)\n", forgotten, len(decisions))
+			return nil
+		}
+
+		log.Printf("Removed %v of %v snapshot(s)", forgotten, len(decisions))
+
+		if !argForgetPrune {
+			return nil
+		}
+
+		_, err = repo.CollectGarbage(cmd.Context(), backup.GCOptions{})
+		return err
+	},
+}
+
+// parseDays extends time.ParseDuration with a "d" (days) suffix. An empty string means zero
+func parseDays(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		count, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %w", value, err)
+		}
+
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
 var argExportFlat bool
 
-// TODO: Support picking a previous snapshot?
 var CmdExport = &cobra.Command{
 	Use:   "export targets_glob destination_path",
 	Short: "Export files from the current repository",
 	Long:  "Export files from the current repository",
 	Args:  cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		repo, err := backup.OpenRepository(argDirectory)
+		repo, err := openRepository(backup.LockShared)
 		if err != nil {
 			return err
 		}
@@ -115,11 +430,11 @@ var CmdExport = &cobra.Command{
 			return err
 		}
 
-		if len(repo.Revisions) == 0 {
-			return fail.ErrNoSnapshots
+		snapshot, err := selectSnapshot(repo)
+		if err != nil {
+			return err
 		}
 
-		snapshot := &repo.Revisions[len(repo.Revisions)-1]
 		err = snapshot.ExportByGlob(cmd.Context(), repo, targets, args[1], argExportFlat)
 		if err != nil {
 			return err
@@ -128,3 +443,467 @@ var CmdExport = &cobra.Command{
 		return nil
 	},
 }
+
+var argJSON bool
+
+var CmdSnapshots = &cobra.Command{
+	Use:   "snapshots [targets_glob]",
+	Short: "List the snapshots in the current repository",
+	Long:  "List the snapshots in the current repository. Sizes only account for the blobs matching the glob, if given",
+	Args:  cobra.RangeArgs(0, 1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := openRepository(backup.LockShared)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		targets, err := compileOptionalGlob(args)
+		if err != nil {
+			return err
+		}
+
+		summaries := repo.Summarize(targets)
+
+		if argJSON {
+			return printJSON(summaries)
+		}
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(table, "ID\tTAKEN AT\tSKEW\tBLOBS\tSIZE\tNEW DATA\tTAGS\n")
+		for _, summary := range summaries {
+			fmt.Fprintf(
+				table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				summary.ID,
+				summary.SavedAt.Local().Format(time.DateTime),
+				summary.Skew,
+				summary.Blobs,
+				summary.LogicalSize,
+				summary.NewDataSize,
+				strings.Join(summary.Tags, ","),
+			)
+		}
+
+		return table.Flush()
+	},
+}
+
+var CmdLs = &cobra.Command{
+	Use:   "ls [targets_glob]",
+	Short: "List the blobs in a snapshot",
+	Long:  "List the blobs in a snapshot",
+	Args:  cobra.RangeArgs(0, 1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := openRepository(backup.LockShared)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		targets, err := compileOptionalGlob(args)
+		if err != nil {
+			return err
+		}
+
+		snapshot, err := selectSnapshot(repo)
+		if err != nil {
+			return err
+		}
+
+		blobs := snapshot.ListBlobs(targets)
+
+		if argJSON {
+			return printJSON(blobs)
+		}
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(table, "TYPE\tSIZE\tMD5\tLAST MODIFIED\tNAME\tMETADATA\n")
+		for _, blob := range blobs {
+			metadata := make([]string, 0, len(blob.Metadata))
+			for key, value := range blob.Metadata {
+				if value != nil {
+					metadata = append(metadata, key+"="+*value)
+				}
+			}
+			slices.Sort(metadata)
+
+			fmt.Fprintf(
+				table, "%v\t%v\t%v\t%v\t%v\t%v\n",
+				blob.Type,
+				blob.Size,
+				hex.EncodeToString(blob.ContentMD5),
+				blob.LastModified.Local().Format(time.DateTime),
+				blob.Name,
+				strings.Join(metadata, ","),
+			)
+		}
+
+		return table.Flush()
+	},
+}
+
+var CmdDiff = &cobra.Command{
+	Use:   "diff old_snapshot [new_snapshot]",
+	Short: "Show the differences between two snapshots",
+	Long:  "Show the differences between two snapshots. The new snapshot defaults to the latest one",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := openRepository(backup.LockShared)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		oldSnapshot, err := repo.FindSnapshot(args[0])
+		if err != nil {
+			return err
+		}
+
+		newRef := "latest"
+		if len(args) == 2 {
+			newRef = args[1]
+		}
+
+		newSnapshot, err := repo.FindSnapshot(newRef)
+		if err != nil {
+			return err
+		}
+
+		diff := oldSnapshot.Diff(newSnapshot)
+
+		if argJSON {
+			return printJSON(diff)
+		}
+
+		for _, blob := range diff.Blobs {
+			switch blob.Kind {
+			case backup.DiffAdded:
+				fmt.Printf("+ %v (%v, %v bytes)\n", blob.Name, blob.Type, blob.NewSize)
+
+			case backup.DiffDeleted:
+				fmt.Printf("- %v (%v, %v bytes)\n", blob.Name, blob.Type, blob.OldSize)
+
+			case backup.DiffRecreated:
+				fmt.Printf("R %v (%v, %v -> %v bytes)\n", blob.Name, blob.Type, blob.OldSize, blob.NewSize)
+
+			case backup.DiffModified:
+				changes := make([]string, 0)
+				if blob.MetadataChanged {
+					changes = append(changes, "metadata")
+				}
+				if blob.Blocks != nil {
+					changes = append(changes, fmt.Sprintf(
+						"blocks +%v (%v bytes) -%v (%v bytes)",
+						len(blob.Blocks.Added), blob.Blocks.AddedBytes,
+						len(blob.Blocks.Removed), blob.Blocks.RemovedBytes,
+					))
+				}
+				if blob.Pages != nil {
+					changes = append(changes, fmt.Sprintf(
+						"pages changed %v range(s), cleared %v range(s)",
+						len(blob.Pages.Changed), len(blob.Pages.Cleared),
+					))
+				}
+				if blob.AppendedBytes > 0 {
+					changes = append(changes, fmt.Sprintf("appended %v bytes", blob.AppendedBytes))
+				}
+				if blob.ContentChanged && len(changes) == 0 {
+					changes = append(changes, "content")
+				}
+
+				fmt.Printf("M %v (%v): %v\n", blob.Name, blob.Type, strings.Join(changes, "; "))
+			}
+		}
+
+		summary := diff.Summary()
+		fmt.Printf(
+			"%v added, %v deleted, %v recreated, %v modified\n",
+			summary[backup.DiffAdded],
+			summary[backup.DiffDeleted],
+			summary[backup.DiffRecreated],
+			summary[backup.DiffModified],
+		)
+
+		return nil
+	},
+}
+
+var argCheckOptions backup.CheckOptions
+
+var CmdCheck = &cobra.Command{
+	Use:   "check",
+	Short: "Verify the integrity of the current repository",
+	Long:  "Verify the integrity of the current repository",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := openRepository(backup.LockShared)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		report := repo.Check(cmd.Context(), argCheckOptions)
+
+		if argJSON {
+			err = printJSON(report)
+			if err != nil {
+				return err
+			}
+		} else {
+			for _, checkErr := range report.Errors {
+				fmt.Printf("[%v] %v: %v\n", checkErr.Kind, checkErr.Object, checkErr.Message)
+			}
+
+			fmt.Printf(
+				"Checked %v snapshot(s), %v FileBuf(s) (%v read back), %v blob checksum(s): %v error(s)\n",
+				report.Snapshots, report.FileBufs, report.FileBufsRead, report.BlobsVerified, len(report.Errors),
+			)
+		}
+
+		if !report.OK() {
+			return fail.ErrCheckFailed
+		}
+
+		return nil
+	},
+}
+
+// compileOptionalGlob compiles the glob from the first argument, matching everything if there's none
+func compileOptionalGlob(args []string) (glob.Glob, error) {
+	if len(args) == 0 {
+		return glob.Compile("*")
+	}
+
+	return glob.Compile(args[0])
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+var argRestoreOverwrite bool
+
+var argUnlockRemoveAll bool
+
+var CmdUnlock = &cobra.Command{
+	Use:   "unlock",
+	Short: "Remove stale locks from the current repository",
+	Long:  "Remove stale locks from the current repository, left behind by crashed processes",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		storage, err := backend.Open(argDirectory)
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+
+		removed, err := backup.RemoveLocks(storage, argUnlockRemoveAll)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Removed %v lock(s)", removed)
+
+		return nil
+	},
+}
+
+var CmdRestore = &cobra.Command{
+	Use:   "restore targets_glob [container_url]",
+	Short: "Restore blobs from the current repository into a container",
+	Long:  "Restore blobs from the current repository into a container. By default, the original container is used",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := openRepository(backup.LockShared)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		targets, err := glob.Compile(args[0])
+		if err != nil {
+			return err
+		}
+
+		containerURL := repo.ContainerURL
+		if len(args) == 2 {
+			containerURL = args[1]
+		}
+
+		client, err := azure.OpenClient(containerURL)
+		if err != nil {
+			return err
+		}
+
+		snapshot, err := selectSnapshot(repo)
+		if err != nil {
+			return err
+		}
+
+		err = snapshot.RestoreByGlob(cmd.Context(), repo, targets, client, backup.RestoreOptions{
+			Overwrite: argRestoreOverwrite,
+		})
+		if err != nil {
+			return err
+		}
+
+		return nil
+	},
+}
+
+var argServeListen string
+var argServeAppendOnly bool
+var argServeUser string
+var argServeTLSCert string
+var argServeTLSKey string
+
+var CmdServe = &cobra.Command{
+	Use:   "serve",
+	Short: "Expose the current repository over HTTP",
+	Long:  "Expose the current repository over HTTP, for use as a rest+http:// or rest+https:// backend elsewhere",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options := backend.ServerOptions{
+			AppendOnly: argServeAppendOnly,
+			User:       argServeUser,
+		}
+		if argServeUser != "" {
+			options.Password = os.Getenv(servePasswordEnvVar)
+			if options.Password == "" {
+				return fmt.Errorf("--user requires a password in $%v", servePasswordEnvVar)
+			}
+		}
+
+		storage, err := backend.Open(argDirectory)
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+
+		chunking, err := backup.ReadChunking(storage)
+		if errors.Is(err, fs.ErrNotExist) {
+			chunking = chunker.DefaultParams()
+			fmt.Printf("!! No repository at %v yet, accepting FileBufs of the default chunk size only. Restart the server once it's initialized\n", storage.Location())
+		} else if err != nil {
+			return err
+		}
+		options.MaxDataSize = backup.MaxStoredSize(chunking)
+
+		server := &http.Server{
+			Addr:    argServeListen,
+			Handler: backend.NewServer(storage, options),
+		}
+
+		go func() {
+			<-cmd.Context().Done()
+			_ = server.Close()
+		}()
+
+		log.Printf("Serving %v at %v (append-only: %v)", storage.Location(), argServeListen, argServeAppendOnly)
+
+		if argServeTLSCert != "" {
+			err = server.ListenAndServeTLS(argServeTLSCert, argServeTLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+
+		return err
+	},
+}
+
+var argSnapshot string
+var argAt string
+
+// addSnapshotFlags adds the flags understood by selectSnapshot
+func addSnapshotFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&argSnapshot, "snapshot", "s", "latest", "Snapshot to use: ID, time taken, latest or latest~N")
+	cmd.PersistentFlags().StringVar(&argAt, "at", "", "Use the newest snapshot taken at or before this time")
+}
+
+// selectSnapshot picks the snapshot requested by the --snapshot and --at flags
+func selectSnapshot(repo *backup.Repository) (*backup.Snapshot, error) {
+	if argAt == "" {
+		return repo.FindSnapshot(argSnapshot)
+	}
+
+	at, err := backup.ParseTime(argAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.SnapshotAt(at)
+}
+
+// openRepository opens the repository in the working directory, taking a lock of the given mode,
+// and unlocks its encryption if needed
+func openRepository(mode backup.LockMode) (*backup.Repository, error) {
+	storage, err := backend.Open(argDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := backup.OpenRepository(storage, mode)
+	if err != nil {
+		return nil, errors.Join(err, storage.Close())
+	}
+
+	if repo.Encryption == nil {
+		return repo, nil
+	}
+
+	secret, err := readSecret(false)
+	if err == nil {
+		err = repo.Unlock(secret)
+	}
+	if err != nil {
+		return nil, errors.Join(err, repo.Discard())
+	}
+
+	return repo, nil
+}
+
+// readSecret gathers the repository secret from the key file, the password file
+// or the environment, in that order. Returns nil if none are provided.
+// If generateKeyFile is set, a missing key file is created with a fresh random key.
+func readSecret(generateKeyFile bool) ([]byte, error) {
+	if argKeyFile != "" {
+		secret, err := os.ReadFile(argKeyFile)
+		if errors.Is(err, os.ErrNotExist) && generateKeyFile {
+			secret = make([]byte, 32)
+			_, err = rand.Read(secret)
+			if err != nil {
+				return nil, err
+			}
+
+			err = os.WriteFile(argKeyFile, secret, 0600)
+			if err != nil {
+				return nil, err
+			}
+
+			log.Printf("Generated a new key file at %v. Keep it safe: without it, the backups can't be read", argKeyFile)
+			return secret, nil
+		}
+
+		return secret, err
+	}
+
+	if argPasswordFile != "" {
+		secret, err := os.ReadFile(argPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes.TrimRight(secret, "\r\n"), nil
+	}
+
+	if password := os.Getenv(passwordEnvVar); password != "" {
+		return []byte(password), nil
+	}
+
+	return nil, nil
+}
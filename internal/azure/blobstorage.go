@@ -2,14 +2,19 @@ package azure
 
 import (
 	"context"
+	"fmt"
 	"iter"
 	"net/url"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"golang.org/x/sync/errgroup"
 )
 
 // IterBlobs provides an iterator over all blobs in a container
@@ -39,23 +44,34 @@ type ContainerSnapshot struct {
 	Client  *container.Client
 	TakenAt time.Time
 	Blobs   []BlobInfo
+	// StartedAt is the server time of the earliest blob snapshot
+	StartedAt time.Time
+	// Skew is the time between the earliest and the latest blob snapshot
+	Skew time.Duration
+	// parallel is the number of concurrent requests used to create and delete the snapshots
+	parallel int
 }
 
 // BlobInfo stores the information sufficient to reference a blob snapshot within a known container
 type BlobInfo struct {
 	Name         string
 	Snapshot     string
-	LastModified time.Time // TODO: May be checked against TakenAt to make sure the whole snapshot was atomic
+	LastModified time.Time
+	ETag         azcore.ETag
+	// Retained snapshots are kept on the server by Delete
+	Retained bool
 }
 
-// TakeSnapshot takes snapshots of all blobs in a container
-func TakeSnapshot(ctx context.Context, client *container.Client) (*ContainerSnapshot, error) {
+// TakeSnapshot takes snapshots of all blobs in a container, up to parallel at a time.
+// Blobs deleted after the listing are left out, and their names are returned separately
+func TakeSnapshot(ctx context.Context, client *container.Client, parallel int) (*ContainerSnapshot, []string, error) {
 	success := false
 
 	result := &ContainerSnapshot{
-		Client:  client,
-		TakenAt: time.Now(),
-		Blobs:   nil,
+		Client:   client,
+		TakenAt:  time.Now(),
+		Blobs:    nil,
+		parallel: max(parallel, 1),
 	}
 
 	// Clean up the snapshots if an error occurs
@@ -65,46 +81,291 @@ func TakeSnapshot(ctx context.Context, client *container.Client) (*ContainerSnap
 		}
 	}()
 
+	// The listing is done up front, so that the snapshots themselves are taken as close together as possible
 	for blob, err := range IterBlobs(ctx, client) {
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		if blob.Snapshot != nil || (blob.Deleted != nil && *blob.Deleted) {
 			continue
 		}
 
-		blobClient := client.NewBlobClient(*blob.Name)
-		snapshotResp, err := blobClient.CreateSnapshot(ctx, nil)
+		result.Blobs = append(result.Blobs, BlobInfo{
+			Name: *blob.Name,
+		})
+	}
+
+	deleted := make([]bool, len(result.Blobs))
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(result.parallel)
+
+	for i := range result.Blobs {
+		group.Go(func() error {
+			blobInfo := &result.Blobs[i]
+
+			snapshotResp, err := client.NewBlobClient(blobInfo.Name).CreateSnapshot(groupCtx, nil)
+			if bloberror.HasCode(err, bloberror.BlobNotFound) {
+				deleted[i] = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			blobInfo.Snapshot = *snapshotResp.Snapshot
+			blobInfo.LastModified = *snapshotResp.LastModified
+			blobInfo.ETag = *snapshotResp.ETag
+			return nil
+		})
+	}
+
+	err := group.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deletedNames := result.dropBlobs(deleted)
+
+	err = result.updateSkew()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	success = true
+	return result, deletedNames, nil
+}
+
+// ResumeSnapshot reconstructs a container snapshot taken earlier, e.g. by an interrupted backup.
+// The recorded blob snapshots are reused if they still exist, and are taken anew otherwise.
+// Blobs that have been deleted since are left out, and their names are returned separately
+func ResumeSnapshot(ctx context.Context, client *container.Client, takenAt time.Time, blobs []BlobInfo, parallel int) (*ContainerSnapshot, []string, error) {
+	result := &ContainerSnapshot{
+		Client:   client,
+		TakenAt:  takenAt,
+		Blobs:    slices.Clone(blobs),
+		parallel: max(parallel, 1),
+	}
+	deleted := make([]bool, len(result.Blobs))
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(result.parallel)
+
+	for i := range result.Blobs {
+		group.Go(func() error {
+			blobInfo := &result.Blobs[i]
+
+			snapshotClient, err := client.NewBlobClient(blobInfo.Name).WithSnapshot(blobInfo.Snapshot)
+			if err != nil {
+				return err
+			}
+
+			_, err = snapshotClient.GetProperties(groupCtx, nil)
+			if err == nil {
+				return nil
+			}
+			if !bloberror.HasCode(err, bloberror.BlobNotFound) {
+				return err
+			}
+
+			snapshotResp, err := client.NewBlobClient(blobInfo.Name).CreateSnapshot(groupCtx, nil)
+			if bloberror.HasCode(err, bloberror.BlobNotFound) {
+				deleted[i] = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			blobInfo.Snapshot = *snapshotResp.Snapshot
+			blobInfo.LastModified = *snapshotResp.LastModified
+			blobInfo.ETag = *snapshotResp.ETag
+			return nil
+		})
+	}
+
+	err := group.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deletedNames := result.dropBlobs(deleted)
+
+	err = result.updateSkew()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, deletedNames, nil
+}
+
+// dropBlobs removes the marked blobs and returns their names
+func (c *ContainerSnapshot) dropBlobs(marked []bool) []string {
+	var names []string
+	remaining := c.Blobs[:0]
+	for i, blobInfo := range c.Blobs {
+		if marked[i] {
+			names = append(names, blobInfo.Name)
+		} else {
+			remaining = append(remaining, blobInfo)
+		}
+	}
+	c.Blobs = remaining
+
+	return names
+}
+
+// updateSkew finds the spread of the snapshot timestamps, which have a sub-second precision unlike the response dates
+func (c *ContainerSnapshot) updateSkew() error {
+	var earliest, latest time.Time
+
+	for i, blob := range c.Blobs {
+		takenAt, err := time.Parse(time.RFC3339Nano, blob.Snapshot)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("malformed snapshot timestamp %q: %w", blob.Snapshot, err)
 		}
 
-		result.Blobs = append(result.Blobs, BlobInfo{
-			Name:         *blob.Name,
-			Snapshot:     *snapshotResp.Snapshot,
-			LastModified: *snapshotResp.LastModified,
+		if i == 0 || takenAt.Before(earliest) {
+			earliest = takenAt
+		}
+		if i == 0 || takenAt.After(latest) {
+			latest = takenAt
+		}
+	}
+
+	c.StartedAt = earliest
+	c.Skew = latest.Sub(earliest)
+	return nil
+}
+
+// Modified returns the indices of the blobs that were modified after the container snapshot was started.
+// Since LastModified only has a precision of a second, blobs modified within the same second are included as well
+func (c *ContainerSnapshot) Modified() []int {
+	var result []int
+
+	// Note: the server clock is used for both sides of the comparison
+	startedAt := c.StartedAt.Truncate(time.Second)
+	for i, blob := range c.Blobs {
+		if !blob.LastModified.Before(startedAt) {
+			result = append(result, i)
+		}
+	}
+
+	return result
+}
+
+// Resnapshot takes new snapshots of the blobs with the given indices, replacing the old ones.
+// Returns the indices of the blobs that changed since their previous snapshot, i.e. are not yet stable.
+// Blobs deleted in the meantime are left out, and their names are returned separately
+func (c *ContainerSnapshot) Resnapshot(ctx context.Context, indices []int) ([]int, []string, error) {
+	changed := make([]bool, len(indices))
+	deleted := make([]bool, len(c.Blobs))
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(c.parallel)
+
+	for j, i := range indices {
+		group.Go(func() error {
+			blobInfo := &c.Blobs[i]
+
+			snapshotResp, err := c.Client.NewBlobClient(blobInfo.Name).CreateSnapshot(groupCtx, nil)
+			if bloberror.HasCode(err, bloberror.BlobNotFound) {
+				deleted[i] = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if !blobInfo.Retained {
+				_ = DeleteSnapshot(groupCtx, c.Client, blobInfo.Name, blobInfo.Snapshot)
+			}
+
+			changed[j] = *snapshotResp.ETag != blobInfo.ETag
+			blobInfo.Snapshot = *snapshotResp.Snapshot
+			blobInfo.LastModified = *snapshotResp.LastModified
+			blobInfo.ETag = *snapshotResp.ETag
+			return nil
 		})
 	}
 
-	success = true
-	return result, nil
+	err := group.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The indices shift as the deleted blobs are dropped
+	shift := make([]int, len(c.Blobs))
+	dropped := 0
+	for i := range c.Blobs {
+		shift[i] = dropped
+		if deleted[i] {
+			dropped++
+		}
+	}
+
+	var result []int
+	for j, i := range indices {
+		if changed[j] && !deleted[i] {
+			result = append(result, i-shift[i])
+		}
+	}
+
+	deletedNames := c.dropBlobs(deleted)
+
+	return result, deletedNames, c.updateSkew()
 }
 
-// Delete cleans up the snapshots from the server
+// DeleteSnapshots cleans up the given blob snapshots from the server, except for the retained ones
+func DeleteSnapshots(ctx context.Context, client *container.Client, blobs []BlobInfo, parallel int) {
+	(&ContainerSnapshot{
+		Client:   client,
+		Blobs:    blobs,
+		parallel: parallel,
+	}).Delete(ctx)
+}
+
+// Delete cleans up the snapshots from the server, except for the retained ones
 func (c *ContainerSnapshot) Delete(ctx context.Context) {
+	// Note: errors are ignored, so the plain group suffices
+	var group errgroup.Group
+	group.SetLimit(max(c.parallel, 1))
+
 	for _, blob := range c.Blobs {
-		snapshotClient, err := c.Client.NewBlobClient(blob.Name).WithSnapshot(blob.Snapshot)
-		if err != nil {
+		// Blobs for which the snapshot was never created are skipped as well
+		if blob.Retained || blob.Snapshot == "" {
 			continue
 		}
-		_, _ = snapshotClient.Delete(ctx, nil)
+
+		group.Go(func() error {
+			_ = DeleteSnapshot(ctx, c.Client, blob.Name, blob.Snapshot)
+			return nil
+		})
 	}
+
+	_ = group.Wait()
 }
 
-func OpenClient(containerURL string) (*container.Client, error) {
+// DeleteSnapshot deletes a single blob snapshot from the server
+func DeleteSnapshot(ctx context.Context, client *container.Client, name string, snapshot string) error {
+	snapshotClient, err := client.NewBlobClient(name).WithSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	_, err = snapshotClient.Delete(ctx, nil)
+	return err
+}
+
+// IsAzurite reports whether a URL points to the local Azurite emulator, whose paths start with the account name
+func IsAzurite(containerURL string) bool {
 	// For local testing, assume localhost means azurite
-	if strings.HasPrefix(containerURL, "http://127.0.0.1") {
+	return strings.HasPrefix(containerURL, "http://127.0.0.1")
+}
+
+func OpenClient(containerURL string) (*container.Client, error) {
+	if IsAzurite(containerURL) {
 		parsedURL, err := url.Parse(containerURL)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,85 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+)
+
+const (
+	// leaseDuration is the duration of a blob lease in seconds, the shortest one allowed.
+	// A short lease expires soon after the process dies, even if it never got to release it
+	leaseDuration = 15
+	// leaseRenewInterval leaves enough margin for a couple of failed renewals
+	leaseRenewInterval = 5 * time.Second
+)
+
+// BlobLease is a lease on a blob, renewed in the background until released.
+// While it's held, nobody else can modify or delete the blob, and thus its snapshots
+type BlobLease struct {
+	Name   string
+	client *lease.BlobClient
+	stop   context.CancelFunc
+	done   chan struct{}
+}
+
+// AcquireLease leases a blob and starts renewing the lease.
+// The errors are returned as is, so that the caller may check for BlobNotFound or LeaseAlreadyPresent
+func AcquireLease(ctx context.Context, client *container.Client, name string) (*BlobLease, error) {
+	leaseClient, err := lease.NewBlobClient(client.NewBlobClient(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = leaseClient.AcquireLease(ctx, leaseDuration, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Note: the renewal must outlive the cancellation of ctx up until the lease is released
+	renewCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+
+	result := &BlobLease{
+		Name:   name,
+		client: leaseClient,
+		stop:   stop,
+		done:   make(chan struct{}),
+	}
+
+	go result.renew(renewCtx)
+
+	return result, nil
+}
+
+func (l *BlobLease) renew(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := l.client.RenewLease(ctx, nil)
+		if err != nil && ctx.Err() == nil {
+			// The next tick may still make it in time
+			fmt.Printf("!! Failed to renew the lease on %q: %v\n", l.Name, err)
+		}
+	}
+}
+
+// Release stops the renewal and releases the lease. Should be given a context that isn't cancelled yet
+func (l *BlobLease) Release(ctx context.Context) error {
+	l.stop()
+	<-l.done
+
+	_, err := l.client.ReleaseLease(ctx, nil)
+	return err
+}
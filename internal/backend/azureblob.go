@@ -0,0 +1,317 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/abel1502/mipt-kp-m-test/internal/azure"
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+// AzureBlob stores a repository as block blobs in an Azure container, typically in another storage account
+type AzureBlob struct {
+	client  *container.Client
+	prefix  string
+	options AzureBlobOptions
+}
+
+// AzureBlobOptions configures how the repository blobs are stored
+type AzureBlobOptions struct {
+	// Tier is the access tier of the FileBufs. Everything else is read too often, so it gets the account default.
+	// Backups and gc without quarantine never read FileBufs, so they work with the Archive tier as well.
+	// Restoring, exporting, quarantining and reading the data back with check need the FileBufs rehydrated by hand
+	Tier *azblob.AccessTier
+	// ImmutableFor protects the FileBufs and snapshot indices from modification and deletion for this long after upload.
+	// Requires version-level immutability support on the container
+	ImmutableFor time.Duration
+	// ImmutabilityMode is either unlocked, so that the policy may still be shortened, or locked
+	ImmutabilityMode azblob.ImmutabilityPolicySetting
+	// LegalHold protects the FileBufs and snapshot indices until the hold is cleared by hand
+	LegalHold bool
+}
+
+// NewAzureBlob stores the repository in a container. Blobs are named with prefix
+func NewAzureBlob(client *container.Client, prefix string, options AzureBlobOptions) *AzureBlob {
+	return &AzureBlob{
+		client:  client,
+		prefix:  strings.Trim(prefix, "/"),
+		options: options,
+	}
+}
+
+// openAzureBlob parses a location of the form azure+https://account.blob.core.windows.net/container/prefix?tier=Cool&immutable_days=30&immutability=locked&legal_hold=true
+func openAzureBlob(location *url.URL) (*AzureBlob, error) {
+	query := location.Query()
+	options := AzureBlobOptions{}
+
+	if value := query.Get("tier"); value != "" {
+		tier, err := parseAccessTier(value)
+		if err != nil {
+			return nil, err
+		}
+		options.Tier = &tier
+	}
+
+	if value := query.Get("immutable_days"); value != "" {
+		days, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid immutable_days: %w", err)
+		}
+		options.ImmutableFor = time.Duration(days) * 24 * time.Hour
+	}
+
+	switch mode := query.Get("immutability"); mode {
+	case "", "unlocked":
+		options.ImmutabilityMode = azblob.ImmutabilityPolicySettingUnlocked
+	case "locked":
+		options.ImmutabilityMode = azblob.ImmutabilityPolicySettingLocked
+	default:
+		return nil, fmt.Errorf("unknown immutability mode: %q", mode)
+	}
+
+	if value := query.Get("legal_hold"); value != "" {
+		legalHold, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid legal_hold: %w", err)
+		}
+		options.LegalHold = legalHold
+	}
+
+	containerURL := url.URL{
+		Scheme: strings.TrimPrefix(location.Scheme, "azure+"),
+		Host:   location.Host,
+	}
+
+	// The container is the first path element, after the account for Azurite
+	elems := strings.Split(strings.Trim(location.Path, "/"), "/")
+	containerElems := 1
+	if azure.IsAzurite(containerURL.String()) {
+		containerElems = 2
+	}
+	if len(elems) < containerElems || elems[containerElems-1] == "" {
+		return nil, fmt.Errorf("no container in Azure location %q", location.Redacted())
+	}
+	containerURL.Path = "/" + path.Join(elems[:containerElems]...)
+
+	client, err := azure.OpenClient(containerURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAzureBlob(client, path.Join(elems[containerElems:]...), options), nil
+}
+
+func parseAccessTier(value string) (azblob.AccessTier, error) {
+	for _, tier := range []azblob.AccessTier{
+		azblob.AccessTierHot,
+		azblob.AccessTierCool,
+		azblob.AccessTierCold,
+		azblob.AccessTierArchive,
+	} {
+		if strings.EqualFold(value, string(tier)) {
+			return tier, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown access tier: %q", value)
+}
+
+func (a *AzureBlob) Location() string {
+	return strings.TrimSuffix("azure+"+a.client.URL()+"/"+a.prefix, "/")
+}
+
+func (a *AzureBlob) key(kind Kind, name string) (string, error) {
+	key, err := key(kind, name)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(a.prefix, key), nil
+}
+
+// protects reports whether objects of a kind get the immutability policy and the legal hold.
+// The rest are either replaced or removed in normal operation
+func protects(kind Kind) bool {
+	return kind == KindData || kind == KindIndex
+}
+
+// Protects reports whether the objects of a kind are uploaded with an immutability policy or a legal hold.
+// Once those expire or are cleared, the repository has to be opened without them to delete anything
+func (a *AzureBlob) Protects(kind Kind) bool {
+	return protects(kind) && (a.options.ImmutableFor > 0 || a.options.LegalHold)
+}
+
+// Archives reports whether the objects of a kind are uploaded to the Archive tier
+func (a *AzureBlob) Archives(kind Kind) bool {
+	return kind == KindData && a.options.Tier != nil && *a.options.Tier == azblob.AccessTierArchive
+}
+
+// azureError translates the missing blob errors into fs.ErrNotExist,
+// the protected blob ones into fail.ErrProtected and the archived blob ones into fail.ErrArchived
+func azureError(op string, key string, err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+	}
+	if bloberror.HasCode(err, bloberror.BlobImmutableDueToPolicy) {
+		return fmt.Errorf("%w: %v %q: %w", fail.ErrProtected, op, key, err)
+	}
+	if bloberror.HasCode(err, bloberror.BlobArchived) {
+		return fmt.Errorf("%w: %v %q: %w", fail.ErrArchived, op, key, err)
+	}
+
+	return err
+}
+
+// Put uploads a blob in a single request, which is atomic
+func (a *AzureBlob) Put(kind Kind, name string, data []byte) error {
+	ctx := context.Background()
+	key, err := a.key(kind, name)
+	if err != nil {
+		return err
+	}
+	blobClient := a.client.NewBlockBlobClient(key)
+
+	contentMD5 := md5.Sum(data)
+	options := &blockblob.UploadOptions{
+		HTTPHeaders: &azblob.HTTPHeaders{
+			BlobContentType: azure.Addressof("application/octet-stream"),
+			BlobContentMD5:  contentMD5[:],
+		},
+		TransactionalValidation: azblob.TransferValidationTypeMD5(contentMD5[:]),
+	}
+
+	if kind == KindData {
+		options.Tier = a.options.Tier
+	}
+
+	if protects(kind) {
+		if a.options.ImmutableFor > 0 {
+			options.ImmutabilityPolicyMode = azure.Addressof(a.options.ImmutabilityMode)
+			options.ImmutabilityPolicyExpiryTime = azure.Addressof(time.Now().Add(a.options.ImmutableFor))
+		}
+		if a.options.LegalHold {
+			options.LegalHold = azure.Addressof(true)
+		}
+	}
+
+	_, err = blobClient.Upload(ctx, streaming.NopCloser(bytes.NewReader(data)), options)
+	return azureError("put", key, err)
+}
+
+func (a *AzureBlob) Get(kind Kind, name string) (io.ReadCloser, error) {
+	key, err := a.key(kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.NewBlobClient(key).DownloadStream(context.Background(), nil)
+	if err != nil {
+		return nil, azureError("get", key, err)
+	}
+
+	return resp.Body, nil
+}
+
+func (a *AzureBlob) Stat(kind Kind, name string) (ObjectInfo, error) {
+	key, err := a.key(kind, name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	props, err := a.client.NewBlobClient(key).GetProperties(context.Background(), nil)
+	if err != nil {
+		return ObjectInfo{}, azureError("stat", key, err)
+	}
+
+	return ObjectInfo{
+		Name: name,
+		Size: *props.ContentLength,
+	}, nil
+}
+
+func (a *AzureBlob) List(kind Kind) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		ctx := context.Background()
+
+		prefix := path.Join(a.prefix, dir(kind))
+		if prefix != "" {
+			prefix += "/"
+		}
+
+		// Note: config objects live in the root, next to all the other directories,
+		// so only the fanned out kinds may be listed without a delimiter
+		if fanout(kind) {
+			pager := a.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+				Prefix: &prefix,
+			})
+
+			for pager.More() {
+				page, err := pager.NextPage(ctx)
+				if err != nil {
+					yield(ObjectInfo{}, err)
+					return
+				}
+
+				for _, item := range page.Segment.BlobItems {
+					if !yield(ObjectInfo{Name: path.Base(*item.Name), Size: *item.Properties.ContentLength}, nil) {
+						return
+					}
+				}
+			}
+
+			return
+		}
+
+		pager := a.client.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{
+			Prefix: &prefix,
+		})
+
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				yield(ObjectInfo{}, err)
+				return
+			}
+
+			for _, item := range page.Segment.BlobItems {
+				if !yield(ObjectInfo{Name: path.Base(*item.Name), Size: *item.Properties.ContentLength}, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Delete removes a blob. Fails for protected blobs until the policy expires or the hold is cleared
+func (a *AzureBlob) Delete(kind Kind, name string) error {
+	key, err := a.key(kind, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.client.NewBlobClient(key).Delete(context.Background(), nil)
+	return azureError("delete", key, err)
+}
+
+func (a *AzureBlob) Close() error {
+	return nil
+}
+
+var _ Backend = (*AzureBlob)(nil)
+var _ Protector = (*AzureBlob)(nil)
+var _ Archiver = (*AzureBlob)(nil)
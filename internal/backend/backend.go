@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"iter"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Kind separates the objects of a repository by their role
+type Kind string
+
+const (
+	// KindConfig is the repository configuration
+	KindConfig Kind = "config"
+	// KindIndex holds the snapshot indices
+	KindIndex Kind = "index"
+	// KindData holds the FileBufs, named by their IDs
+	KindData Kind = "data"
+	// KindLock holds the repository locks
+	KindLock Kind = "lock"
+	// KindJournal holds the checkpoint journal of an unfinished backup
+	KindJournal Kind = "journal"
+	// KindQuarantine holds the FileBufs set aside by garbage collection
+	KindQuarantine Kind = "quarantine"
+)
+
+func (k Kind) Validate() error {
+	switch k {
+	case KindConfig, KindIndex, KindData, KindLock, KindJournal, KindQuarantine:
+		return nil
+	}
+
+	return fmt.Errorf("unknown object kind: %q", k)
+}
+
+// dir is the directory holding the objects of a kind, relative to the repository root.
+// All backends share this layout, so a repository may be copied from one to another as is
+func dir(kind Kind) string {
+	switch kind {
+	case KindConfig:
+		return ""
+	case KindIndex:
+		return "snapshots"
+	case KindData:
+		return "files"
+	case KindLock:
+		return "locks"
+	case KindJournal:
+		return "journal"
+	case KindQuarantine:
+		return "quarantine"
+	default:
+		panic(kind.Validate())
+	}
+}
+
+// fanout reports whether the objects of a kind are spread over subdirectories by the first byte of the name
+func fanout(kind Kind) bool {
+	return kind == KindData || kind == KindQuarantine
+}
+
+// key is the slash-separated path to an object, relative to the repository root
+func key(kind Kind, name string) (string, error) {
+	err := checkName(kind, name)
+	if err != nil {
+		return "", err
+	}
+
+	if fanout(kind) {
+		// TODO: Do I need this separation by the first byte?
+		return path.Join(dir(kind), name[:2], name), nil
+	}
+
+	return path.Join(dir(kind), name), nil
+}
+
+// checkName rejects the object names that could escape the directory of their kind
+func checkName(kind Kind, name string) error {
+	err := kind.Validate()
+	if err != nil {
+		return err
+	}
+
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid object name: %q", name)
+	}
+
+	if fanout(kind) && len(name) < 2 {
+		return fmt.Errorf("object name too short: %q", name)
+	}
+
+	return nil
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Backend stores the objects a repository consists of.
+// Objects are immutable once written, except for config and lock objects,
+// which may be replaced by another Put. Missing objects are reported with fs.ErrNotExist
+type Backend interface {
+	// Location describes where the repository is stored
+	Location() string
+	// Put stores an object, replacing an existing one. Either the whole object is stored, or none of it
+	Put(kind Kind, name string, data []byte) error
+	// Get opens an object for reading
+	Get(kind Kind, name string) (io.ReadCloser, error)
+	// Stat describes an object without reading it
+	Stat(kind Kind, name string) (ObjectInfo, error)
+	// List enumerates all objects of a kind, in no particular order
+	List(kind Kind) iter.Seq2[ObjectInfo, error]
+	// Delete removes an object
+	Delete(kind Kind, name string) error
+	// Close releases the resources held by the backend
+	Close() error
+}
+
+// Cleaner is implemented by backends that may leave temporary objects behind after a crash
+type Cleaner interface {
+	// Cleanup removes the leftovers. Must only be called while nobody else is writing to the repository
+	Cleanup() error
+}
+
+// Protector is implemented by backends that may keep objects from being deleted or replaced
+type Protector interface {
+	// Protects reports whether the objects of a kind are protected
+	Protects(kind Kind) bool
+}
+
+// Archiver is implemented by backends that may store objects offline, so that they can't be read until rehydrated
+type Archiver interface {
+	// Archives reports whether the objects of a kind are stored offline
+	Archives(kind Kind) bool
+}
+
+// ReadAll reads a whole object
+func ReadAll(b Backend, kind Kind, name string) ([]byte, error) {
+	reader, err := b.Get(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// Open connects to the backend a location refers to. Locations without a scheme are local directories,
+// others are URLs with the backend options passed as query parameters
+func Open(location string) (Backend, error) {
+	if !strings.Contains(location, "://") {
+		return NewLocal(location), nil
+	}
+
+	parsedURL, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsedURL.Scheme {
+	case "file":
+		return NewLocal(parsedURL.Path), nil
+	case "s3":
+		return openS3(parsedURL)
+	case "azure+http", "azure+https":
+		return openAzureBlob(parsedURL)
+	case "sftp":
+		return openSFTP(parsedURL)
+	case "rest+http", "rest+https":
+		return openREST(parsedURL)
+	default:
+		return nil, fmt.Errorf("unsupported backend: %q", parsedURL.Scheme)
+	}
+}
+
+// Join appends a path element to a location
+func Join(location string, elem string) string {
+	if !strings.Contains(location, "://") {
+		return filepath.Join(location, elem)
+	}
+
+	// filepath.Join would mangle the scheme separator, and the options must stay at the end
+	parsedURL, err := url.Parse(location)
+	if err != nil {
+		return strings.TrimSuffix(location, "/") + "/" + elem
+	}
+
+	parsedURL.Path = path.Join("/", parsedURL.Path, elem)
+	return parsedURL.String()
+}
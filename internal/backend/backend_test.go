@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		kind Kind
+		name string
+		want string
+	}{
+		{KindConfig, "info.json", "info.json"},
+		{KindIndex, "20261018120000.json", "snapshots/20261018120000.json"},
+		{KindData, "abcdef", "files/ab/abcdef"},
+		{KindQuarantine, "ab", "quarantine/ab/ab"},
+		{KindData, "a", ""},
+		{KindData, "", ""},
+		{KindIndex, "../info.json", ""},
+		{KindIndex, ".hidden", ""},
+		{KindLock, `a\b`, ""},
+		{"unknown", "name", ""},
+	}
+
+	for _, test := range tests {
+		got, err := key(test.kind, test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("key(%v, %q) = %q, want an error", test.kind, test.name, got)
+			}
+			continue
+		}
+
+		if err != nil || got != test.want {
+			t.Errorf("key(%v, %q) = %q, %v, want %q", test.kind, test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestLocalRejectsInvalidNames(t *testing.T) {
+	storage := NewLocal(t.TempDir())
+
+	err := storage.Put(KindData, "a", []byte("data"))
+	if err == nil {
+		t.Error("Put accepted a name too short to fan out")
+	}
+
+	_, err = storage.Stat(KindIndex, "../info.json")
+	if err == nil {
+		t.Error("Stat accepted a name escaping its directory")
+	}
+}
@@ -0,0 +1,227 @@
+package backend
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempSuffix marks the files that are still being written. They're never read, and removed by Cleanup if orphaned
+const tempSuffix = ".tmp"
+
+// Local stores a repository in a directory on the local filesystem
+type Local struct {
+	root string
+}
+
+// NewLocal uses the directory at root, which is created on the first write if needed
+func NewLocal(root string) *Local {
+	return &Local{
+		root: root,
+	}
+}
+
+func (l *Local) Location() string {
+	return l.root
+}
+
+// dir is the directory holding the objects of a kind
+func (l *Local) dir(kind Kind) string {
+	return filepath.Join(l.root, filepath.FromSlash(dir(kind)))
+}
+
+func (l *Local) path(kind Kind, name string) (string, error) {
+	key, err := key(kind, name)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file, syncs it and renames it into place,
+// so that even after a crash the object either has its old contents or the new ones in full
+func (l *Local) Put(kind Kind, name string, data []byte) error {
+	path, err := l.path(kind, name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+
+	success := false
+	defer func() {
+		if !success {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	// CreateTemp makes the file private, unlike the rest of the repository
+	err = file.Chmod(0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return err
+	}
+	success = true
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir makes a rename within dir durable. Best effort, since not every platform supports it
+func syncDir(dir string) {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer handle.Close()
+
+	_ = handle.Sync()
+}
+
+func (l *Local) Get(kind Kind, name string) (io.ReadCloser, error) {
+	path, err := l.path(kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (l *Local) Stat(kind Kind, name string) (ObjectInfo, error) {
+	path, err := l.path(kind, name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Name: name,
+		Size: info.Size(),
+	}, nil
+}
+
+func (l *Local) List(kind Kind) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		dir := l.dir(kind)
+
+		err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if entry.IsDir() {
+				// Note: config objects live in the root, next to all the other directories
+				if path != dir && !fanout(kind) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if strings.HasSuffix(entry.Name(), tempSuffix) {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				// Deleted in the meantime
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if !yield(ObjectInfo{Name: entry.Name(), Size: info.Size()}, nil) {
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			yield(ObjectInfo{}, err)
+		}
+	}
+}
+
+func (l *Local) Delete(kind Kind, name string) error {
+	path, err := l.path(kind, name)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (l *Local) Close() error {
+	return nil
+}
+
+// Cleanup deletes the temporary files left behind by crashed processes
+func (l *Local) Cleanup() error {
+	err := filepath.WalkDir(l.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			// Shared lock holders keep refreshing theirs
+			if path == l.dir(KindLock) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(entry.Name(), tempSuffix) {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+var _ Backend = (*Local)(nil)
+var _ Cleaner = (*Local)(nil)
@@ -0,0 +1,170 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// restTimeout bounds a single request, including reading the response. FileBufs are small enough for it to be generous
+const restTimeout = 5 * time.Minute
+
+// REST stores a repository on a server speaking the protocol of Server, such as the one run by the serve command
+type REST struct {
+	client  *http.Client
+	baseURL *url.URL
+}
+
+// NewREST talks to the server at baseURL. Credentials in the URL are sent with basic authentication
+func NewREST(baseURL *url.URL) *REST {
+	result := *baseURL
+	result.Path = strings.TrimSuffix(result.Path, "/")
+
+	return &REST{
+		client:  &http.Client{Timeout: restTimeout},
+		baseURL: &result,
+	}
+}
+
+// openREST parses a location of the form rest+https://[user:password@]host[:port]/path
+func openREST(location *url.URL) (*REST, error) {
+	baseURL := *location
+	baseURL.Scheme = strings.TrimPrefix(location.Scheme, "rest+")
+
+	return NewREST(&baseURL), nil
+}
+
+func (r *REST) Location() string {
+	return "rest+" + r.baseURL.Redacted()
+}
+
+func (r *REST) url(kind Kind, name string) (string, error) {
+	err := checkName(kind, name)
+	if err != nil {
+		return "", err
+	}
+
+	return r.baseURL.JoinPath(string(kind), name).String(), nil
+}
+
+// do sends a request and fails on unexpected statuses. A missing object is reported with fs.ErrNotExist
+func (r *REST) do(method string, target string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: strings.ToLower(method), Path: request.URL.Redacted(), Err: fs.ErrNotExist}
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%v %v: %v: %v", method, request.URL.Redacted(), resp.Status, strings.TrimSpace(string(message)))
+}
+
+func (r *REST) Put(kind Kind, name string, data []byte) error {
+	target, err := r.url(kind, name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(http.MethodPut, target, data)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (r *REST) Get(kind Kind, name string) (io.ReadCloser, error) {
+	target, err := r.url(kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.do(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (r *REST) Stat(kind Kind, name string) (ObjectInfo, error) {
+	target, err := r.url(kind, name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	resp, err := r.do(http.MethodHead, target, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	_ = resp.Body.Close()
+
+	return ObjectInfo{
+		Name: name,
+		Size: resp.ContentLength,
+	}, nil
+}
+
+func (r *REST) List(kind Kind) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		resp, err := r.do(http.MethodGet, r.baseURL.JoinPath(string(kind)).String()+"/", nil)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		var objects []ObjectInfo
+		err = json.NewDecoder(resp.Body).Decode(&objects)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+
+		for _, object := range objects {
+			if !yield(object, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (r *REST) Delete(kind Kind, name string) error {
+	target, err := r.url(kind, name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(http.MethodDelete, target, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (r *REST) Close() error {
+	return nil
+}
+
+var _ Backend = (*REST)(nil)
@@ -0,0 +1,324 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// defaultS3PartSize is the size of the parts big objects are uploaded in. S3 requires at least 5 MiB
+const defaultS3PartSize = 16 * 1024 * 1024
+
+// S3 stores a repository in a bucket of any S3-compatible object storage.
+// Uploads are atomic there by design, with big objects sent in multiple parts
+type S3 struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// S3Options configures the connection to an S3-compatible service
+type S3Options struct {
+	// Endpoint is the host (and port) of the service, optionally prefixed with http:// or https://.
+	// Defaults to AWS
+	Endpoint string
+	// Region is the bucket region, detected automatically if empty
+	Region string
+	// PathStyle addresses buckets as part of the path instead of the host name, as MinIO and most stand-ins expect
+	PathStyle bool
+	// PartSize is the size of the parts big objects are uploaded in
+	PartSize uint64
+	// CredentialsFile is an AWS shared credentials file, used if the environment doesn't provide the credentials.
+	// Defaults to AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials
+	CredentialsFile string
+	// Profile is the section of the credentials file to use. Defaults to AWS_PROFILE or "default"
+	Profile string
+}
+
+// NewS3 connects to a bucket. Objects are stored under prefix
+func NewS3(bucket string, prefix string, options S3Options) (*S3, error) {
+	endpoint := options.Endpoint
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+
+	secure := true
+	if scheme, host, found := strings.Cut(endpoint, "://"); found {
+		switch scheme {
+		case "http":
+			secure = false
+		case "https":
+		default:
+			return nil, fmt.Errorf("unsupported S3 endpoint scheme: %q", scheme)
+		}
+		endpoint = host
+	}
+
+	bucketLookup := minio.BucketLookupAuto
+	if options.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	// The environment takes precedence over the file, as with the AWS CLI
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{
+			Filename: options.CredentialsFile,
+			Profile:  options.Profile,
+		},
+	})
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       secure,
+		Region:       options.Region,
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	partSize := options.PartSize
+	if partSize == 0 {
+		partSize = defaultS3PartSize
+	}
+
+	return &S3{
+		client:   client,
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		partSize: partSize,
+	}, nil
+}
+
+// openS3 parses a location of the form s3://bucket/prefix?endpoint=...&region=...&path_style=true&part_size=16&credentials_file=...&profile=...
+// The part size is in MiB
+func openS3(location *url.URL) (*S3, error) {
+	query := location.Query()
+
+	options := S3Options{
+		Endpoint:        query.Get("endpoint"),
+		Region:          query.Get("region"),
+		CredentialsFile: query.Get("credentials_file"),
+		Profile:         query.Get("profile"),
+	}
+
+	if value := query.Get("path_style"); value != "" {
+		pathStyle, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_style: %w", err)
+		}
+		options.PathStyle = pathStyle
+	}
+
+	if value := query.Get("part_size"); value != "" {
+		partSize, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid part_size: %w", err)
+		}
+		if partSize < 5 {
+			return nil, fmt.Errorf("part_size must be at least 5 MiB")
+		}
+		options.PartSize = partSize * 1024 * 1024
+	}
+
+	if location.Host == "" {
+		return nil, fmt.Errorf("no bucket in S3 location %q", location.Redacted())
+	}
+
+	return NewS3(location.Host, location.Path, options)
+}
+
+func (s *S3) Location() string {
+	return strings.TrimSuffix(fmt.Sprintf("s3://%v/%v", s.bucket, s.prefix), "/")
+}
+
+func (s *S3) key(kind Kind, name string) (string, error) {
+	key, err := key(kind, name)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(s.prefix, key), nil
+}
+
+// listPrefix is what the keys of all objects of a kind start with
+func (s *S3) listPrefix(kind Kind) string {
+	result := path.Join(s.prefix, dir(kind))
+	if result == "" {
+		return ""
+	}
+
+	return result + "/"
+}
+
+// s3Error translates the missing object errors into fs.ErrNotExist
+func s3Error(op string, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	code := minio.ToErrorResponse(err).Code
+	if code == "NoSuchKey" || code == "NotFound" {
+		return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+	}
+
+	return err
+}
+
+func (s *S3) Put(kind Kind, name string, data []byte) error {
+	key, err := s.key(kind, name)
+	if err != nil {
+		return err
+	}
+
+	// Objects above the part size are uploaded in parts, and only become visible once all of them are there
+	_, err = s.client.PutObject(
+		context.Background(),
+		s.bucket,
+		key,
+		bytes.NewReader(data),
+		int64(len(data)),
+		minio.PutObjectOptions{
+			PartSize:    s.partSize,
+			ContentType: "application/octet-stream",
+			// Lets the service reject the uploads corrupted on the way
+			SendContentMd5: true,
+		},
+	)
+
+	return s3Error("put", key, err)
+}
+
+func (s *S3) Get(kind Kind, name string) (io.ReadCloser, error) {
+	key, err := s.key(kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error("get", key, err)
+	}
+
+	// GetObject is lazy, so a missing object would only be noticed on the first read
+	_, err = object.Stat()
+	if err != nil {
+		_ = object.Close()
+		return nil, s3Error("get", key, err)
+	}
+
+	return object, nil
+}
+
+func (s *S3) Stat(kind Kind, name string) (ObjectInfo, error) {
+	key, err := s.key(kind, name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error("stat", key, err)
+	}
+
+	return ObjectInfo{
+		Name: name,
+		Size: info.Size,
+	}, nil
+}
+
+func (s *S3) List(kind Kind) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+			Prefix: s.listPrefix(kind),
+			// Note: config objects live in the root, next to all the other directories
+			Recursive: fanout(kind),
+		})
+
+		for object := range objects {
+			if object.Err != nil {
+				yield(ObjectInfo{}, object.Err)
+				return
+			}
+
+			// Subdirectories are listed as common prefixes
+			if strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+
+			if !yield(ObjectInfo{Name: path.Base(object.Key), Size: object.Size}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Delete removes an object. S3 doesn't report whether it existed
+func (s *S3) Delete(kind Kind, name string) error {
+	key, err := s.key(kind, name)
+	if err != nil {
+		return err
+	}
+
+	err = s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+	return s3Error("delete", key, err)
+}
+
+func (s *S3) Close() error {
+	return nil
+}
+
+// Cleanup aborts the multipart uploads interrupted by crashed processes, which are billed for otherwise
+func (s *S3) Cleanup() error {
+	ctx := context.Background()
+	// The high-level listing also sizes every upload, which is both slow and unsupported by some stand-ins
+	core := minio.Core{Client: s.client}
+
+	prefix := s.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		result, err := core.ListMultipartUploads(ctx, s.bucket, prefix, keyMarker, uploadIDMarker, "", 1000)
+		if minio.ToErrorResponse(err).Code == "NoSuchUpload" {
+			// Some stand-ins report that instead of an empty list
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, upload := range result.Uploads {
+			err = core.AbortMultipartUpload(ctx, s.bucket, upload.Key, upload.UploadID)
+			if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+}
+
+var _ Backend = (*S3)(nil)
+var _ Cleaner = (*S3)(nil)
@@ -0,0 +1,201 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// The S3 tests run against a real service, e.g. MinIO:
+//
+//	BACKUP_TEST_S3_ENDPOINT=http://localhost:9000 BACKUP_TEST_S3_BUCKET=test \
+//	AWS_ACCESS_KEY_ID=minioadmin AWS_SECRET_ACCESS_KEY=minioadmin go test ./internal/backend
+const (
+	s3EndpointEnvVar = "BACKUP_TEST_S3_ENDPOINT"
+	s3BucketEnvVar   = "BACKUP_TEST_S3_BUCKET"
+)
+
+// newTestS3 connects to the test bucket, creating it if needed. Each test gets a prefix of its own
+func newTestS3(t *testing.T) *S3 {
+	t.Helper()
+
+	endpoint := os.Getenv(s3EndpointEnvVar)
+	if endpoint == "" {
+		t.Skipf("%v is not set", s3EndpointEnvVar)
+	}
+
+	bucket := os.Getenv(s3BucketEnvVar)
+	if bucket == "" {
+		bucket = "backup-test"
+	}
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	storage, err := NewS3(bucket, "test-"+hex.EncodeToString(suffix), S3Options{
+		Endpoint:  endpoint,
+		PathStyle: true,
+		// The smallest allowed, so that multipart uploads are cheap to test
+		PartSize: 5 * 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	exists, err := storage.client.BucketExists(ctx, bucket)
+	if err == nil && !exists {
+		err = storage.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		for object := range storage.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: storage.prefix + "/", Recursive: true}) {
+			if object.Err == nil {
+				_ = storage.client.RemoveObject(ctx, bucket, object.Key, minio.RemoveObjectOptions{})
+			}
+		}
+	})
+
+	return storage
+}
+
+func TestS3Objects(t *testing.T) {
+	storage := newTestS3(t)
+
+	big := make([]byte, 6*1024*1024)
+	_, _ = rand.Read(big)
+
+	objects := []struct {
+		kind Kind
+		name string
+		data []byte
+	}{
+		{KindConfig, "info.json", []byte(`{"version": 1}`)},
+		{KindIndex, "20261018120000.json", []byte(`{"blobs": []}`)},
+		{KindData, "abcdef", []byte("chunk")},
+		{KindData, "abcdeg", []byte{}},
+		{KindData, "fedcba", big},
+	}
+
+	for _, object := range objects {
+		err := storage.Put(object.kind, object.name, object.data)
+		if err != nil {
+			t.Fatalf("Put(%v, %q): %v", object.kind, object.name, err)
+		}
+	}
+
+	for _, object := range objects {
+		data, err := ReadAll(storage, object.kind, object.name)
+		if err != nil {
+			t.Fatalf("Get(%v, %q): %v", object.kind, object.name, err)
+		}
+		if !bytes.Equal(data, object.data) {
+			t.Errorf("Get(%v, %q) returned different contents", object.kind, object.name)
+		}
+
+		info, err := storage.Stat(object.kind, object.name)
+		if err != nil {
+			t.Fatalf("Stat(%v, %q): %v", object.kind, object.name, err)
+		}
+		if info.Name != object.name || info.Size != int64(len(object.data)) {
+			t.Errorf("Stat(%v, %q) = %+v, want size %v", object.kind, object.name, info, len(object.data))
+		}
+	}
+
+	// Config objects share the root with the directories of the other kinds, which mustn't leak into the listing
+	for _, kind := range []Kind{KindConfig, KindIndex, KindData, KindLock} {
+		want := make(map[string]int64)
+		for _, object := range objects {
+			if object.kind == kind {
+				want[object.name] = int64(len(object.data))
+			}
+		}
+
+		got := make(map[string]int64)
+		for info, err := range storage.List(kind) {
+			if err != nil {
+				t.Fatalf("List(%v): %v", kind, err)
+			}
+			got[info.Name] = info.Size
+		}
+
+		if len(got) != len(want) {
+			t.Errorf("List(%v) = %v, want %v", kind, got, want)
+			continue
+		}
+		for name, size := range want {
+			if got[name] != size {
+				t.Errorf("List(%v) = %v, want %v", kind, got, want)
+				break
+			}
+		}
+	}
+
+	err := storage.Delete(KindData, "abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.Stat(KindData, "abcdef")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a deleted object: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestS3NotExist(t *testing.T) {
+	storage := newTestS3(t)
+
+	_, err := storage.Get(KindIndex, "missing.json")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	_, err = storage.Stat(KindIndex, "missing.json")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	for _, err := range storage.List(KindJournal) {
+		t.Errorf("List of an empty kind: got %v", err)
+	}
+}
+
+func TestS3Cleanup(t *testing.T) {
+	storage := newTestS3(t)
+	ctx := context.Background()
+	core := minio.Core{Client: storage.client}
+
+	key, err := storage.key(KindData, "abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As left behind by a crash in the middle of a multipart upload
+	_, err = core.NewMultipartUpload(ctx, storage.bucket, key, minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.Cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := core.ListMultipartUploads(ctx, storage.bucket, storage.prefix+"/", "", "", "", 1000)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+		t.Fatal(err)
+	}
+	if len(result.Uploads) != 0 {
+		t.Errorf("%v multipart upload(s) left after the cleanup", len(result.Uploads))
+	}
+}
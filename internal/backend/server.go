@@ -0,0 +1,215 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Server exposes a backend over HTTP for REST clients:
+//
+//	GET    /<kind>/        lists the objects of a kind as a JSON array
+//	GET    /<kind>/<name>  reads an object
+//	HEAD   /<kind>/<name>  describes an object
+//	PUT    /<kind>/<name>  stores an object
+//	DELETE /<kind>/<name>  removes an object
+type Server struct {
+	storage Backend
+	options ServerOptions
+}
+
+// ServerOptions restricts access to a Server
+type ServerOptions struct {
+	// AppendOnly forbids deleting or changing the stored data, so that a compromised client can't destroy the backups.
+	// Locks and journals are exempt, since backups can't be taken without them
+	AppendOnly bool
+	// User and Password enable basic authentication, if set
+	User     string
+	Password string
+	// MaxDataSize is the largest FileBuf accepted, so that clients can't exhaust the server memory.
+	// Zero means the limit of the other objects, maxMetadataSize
+	MaxDataSize int64
+}
+
+// maxMetadataSize is the largest object of other kinds accepted.
+// Snapshot indices grow with the number of FileBufs, so it's generous
+const maxMetadataSize = 1 << 30
+
+func NewServer(storage Backend, options ServerOptions) *Server {
+	return &Server{
+		storage: storage,
+		options: options,
+	}
+}
+
+// mutable reports whether objects of a kind may be replaced and deleted in append-only mode
+func mutable(kind Kind) bool {
+	return kind == KindLock || kind == KindJournal
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.options.User != "" && !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="backup repository"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rawKind, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	kind := Kind(rawKind)
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.list(w, kind)
+		return
+	}
+
+	err := checkName(kind, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.get(w, kind, name)
+	case http.MethodHead:
+		s.stat(w, kind, name)
+	case http.MethodPut:
+		s.put(w, r, kind, name)
+	case http.MethodDelete:
+		s.delete(w, kind, name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.options.User)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.options.Password)) == 1
+	return userOK && passwordOK
+}
+
+// fail reports a backend error to the client
+func (s *Server) fail(w http.ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Warning: %v", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (s *Server) list(w http.ResponseWriter, kind Kind) {
+	err := kind.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	objects := []ObjectInfo{}
+	for object, err := range s.storage.List(kind) {
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+		objects = append(objects, object)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(objects)
+}
+
+func (s *Server) get(w http.ResponseWriter, kind Kind, name string) {
+	info, err := s.storage.Stat(kind, name)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	reader, err := s.storage.Get(kind, name)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	_, _ = io.Copy(w, reader)
+}
+
+func (s *Server) stat(w http.ResponseWriter, kind Kind, name string) {
+	info, err := s.storage.Stat(kind, name)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, kind Kind, name string) {
+	limit := int64(maxMetadataSize)
+	if (kind == KindData || kind == KindQuarantine) && s.options.MaxDataSize > 0 {
+		limit = s.options.MaxDataSize
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("%v %q is larger than %v bytes", kind, name, limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.options.AppendOnly && !mutable(kind) {
+		_, err = s.storage.Stat(kind, name)
+		if err == nil {
+			http.Error(w, fmt.Sprintf("%v %q exists already and the repository is append-only", kind, name), http.StatusForbidden)
+			return
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.fail(w, err)
+			return
+		}
+	}
+
+	err = s.storage.Put(kind, name, data)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+}
+
+func (s *Server) delete(w http.ResponseWriter, kind Kind, name string) {
+	if s.options.AppendOnly && !mutable(kind) {
+		http.Error(w, fmt.Sprintf("cannot delete %v %q, the repository is append-only", kind, name), http.StatusForbidden)
+		return
+	}
+
+	err := s.storage.Delete(kind, name)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+}
@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"errors"
+	"io/fs"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	appendOnly := ServerOptions{AppendOnly: true}
+	limited := ServerOptions{MaxDataSize: 16}
+	authenticated := ServerOptions{User: "backup", Password: "secret"}
+
+	put := func(kind Kind, name string, size int) func(*REST) error {
+		return func(client *REST) error {
+			return client.Put(kind, name, make([]byte, size))
+		}
+	}
+	remove := func(kind Kind, name string) func(*REST) error {
+		return func(client *REST) error {
+			return client.Delete(kind, name)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options ServerOptions
+		// user is the userinfo of the client URL
+		user *url.Userinfo
+		op   func(*REST) error
+		// want is the status the request fails with, if any
+		want string
+	}{
+		{"put", ServerOptions{}, nil, put(KindData, "abcdef", 4), ""},
+		{"overwrite", ServerOptions{}, nil, put(KindData, "existing", 4), ""},
+		{"delete", ServerOptions{}, nil, remove(KindData, "existing"), ""},
+
+		{"append-only put", appendOnly, nil, put(KindData, "abcdef", 4), ""},
+		{"append-only overwrite data", appendOnly, nil, put(KindData, "existing", 4), "403"},
+		{"append-only overwrite index", appendOnly, nil, put(KindIndex, "existing.json", 4), "403"},
+		{"append-only overwrite config", appendOnly, nil, put(KindConfig, "info.json", 4), "403"},
+		{"append-only delete data", appendOnly, nil, remove(KindData, "existing"), "403"},
+		{"append-only delete index", appendOnly, nil, remove(KindIndex, "existing.json"), "403"},
+		{"append-only delete quarantine", appendOnly, nil, remove(KindQuarantine, "existing"), "403"},
+		{"append-only overwrite lock", appendOnly, nil, put(KindLock, "existing.json", 4), ""},
+		{"append-only delete lock", appendOnly, nil, remove(KindLock, "existing.json"), ""},
+		{"append-only delete journal", appendOnly, nil, remove(KindJournal, "existing.json"), ""},
+
+		{"data within the limit", limited, nil, put(KindData, "abcdef", 16), ""},
+		{"data above the limit", limited, nil, put(KindData, "abcdef", 17), "413"},
+		{"quarantine above the limit", limited, nil, put(KindQuarantine, "abcdef", 17), "413"},
+		{"index above the data limit", limited, nil, put(KindIndex, "new.json", 17), ""},
+
+		{"no credentials", authenticated, nil, put(KindData, "abcdef", 4), "401"},
+		{"wrong password", authenticated, url.UserPassword("backup", "guess"), put(KindData, "abcdef", 4), "401"},
+		{"wrong user", authenticated, url.UserPassword("admin", "secret"), put(KindData, "abcdef", 4), "401"},
+		{"credentials", authenticated, url.UserPassword("backup", "secret"), put(KindData, "abcdef", 4), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewLocal(t.TempDir())
+			for _, object := range []struct {
+				kind Kind
+				name string
+			}{
+				{KindConfig, "info.json"},
+				{KindIndex, "existing.json"},
+				{KindData, "existing"},
+				{KindQuarantine, "existing"},
+				{KindLock, "existing.json"},
+				{KindJournal, "existing.json"},
+			} {
+				err := storage.Put(object.kind, object.name, []byte("old"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			server := httptest.NewServer(NewServer(storage, test.options))
+			defer server.Close()
+
+			baseURL, err := url.Parse(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			baseURL.User = test.user
+
+			err = test.op(NewREST(baseURL))
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want status %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRESTNotExist(t *testing.T) {
+	server := httptest.NewServer(NewServer(NewLocal(t.TempDir()), ServerOptions{User: "backup", Password: "secret"}))
+	defer server.Close()
+
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL.User = url.UserPassword("backup", "secret")
+	client := NewREST(baseURL)
+
+	_, err = client.Stat(KindIndex, "missing.json")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error reveals the password: %v", err)
+	}
+
+	_, err = client.Get(KindData, "missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error reveals the password: %v", err)
+	}
+}
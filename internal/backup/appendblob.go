@@ -1,23 +1,79 @@
 package backup
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/json"
 	"io"
+	"iter"
+	"log"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/appendblob"
+	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/abel1502/mipt-kp-m-test/internal/azure"
 )
 
+// appendTailSize is how much of the end of an append blob is hashed
+// to verify that the next backup only sees new data appended to it
+const appendTailSize = 4096
+
 type AppendBlob struct {
 	CommonBlob
-	// Fragments is the single-linked list of this blob's fragments
-	Fragments *AppendBlobFragment
+	// CommittedBlocks is the number of blocks appended to the blob at the time of the backup
+	CommittedBlocks int32 `json:",omitempty"`
+	// TailMD5 is the MD5 hash of the last appendTailSize bytes of the blob (or all of it, if shorter)
+	TailMD5 []byte `json:",omitempty"`
+	// Fragments is the list of this blob's fragments, in order
+	Fragments AppendFragmentList
 }
 
 type AppendBlobFragment struct {
-	// LastChunk is the last chunk of this blob
-	LastChunk *FileBuf
-	// Previous is the preceding fragment
-	Previous *AppendBlobFragment
+	// Offset is the position of the fragment in the blob
+	Offset uint64
+	// Content is the data appended to the blob by this fragment, split into chunks
+	Content ChunkList
+}
+
+type AppendFragmentList []*AppendBlobFragment
+
+var _ json.Unmarshaler = (*AppendFragmentList)(nil)
+
+// legacyAppendBlobFragment is the reverse linked list used by older snapshots
+type legacyAppendBlobFragment struct {
+	LastChunk ChunkList
+	Previous  *legacyAppendBlobFragment
+}
+
+func (l *AppendFragmentList) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		return json.Unmarshal(data, (*[]*AppendBlobFragment)(l))
+	}
+
+	var legacy legacyAppendBlobFragment
+	err := json.Unmarshal(data, &legacy)
+	if err != nil {
+		return err
+	}
+
+	reversed := make([]ChunkList, 0)
+	for cur := &legacy; cur != nil; cur = cur.Previous {
+		reversed = append(reversed, cur.LastChunk)
+	}
+
+	*l = make(AppendFragmentList, 0, len(reversed))
+	offset := uint64(0)
+	for i := len(reversed) - 1; i >= 0; i-- {
+		*l = append(*l, &AppendBlobFragment{
+			Offset:  offset,
+			Content: reversed[i],
+		})
+		offset += reversed[i].Size()
+	}
+
+	return nil
 }
 
 func DownloadAppendBlob(
@@ -33,37 +89,99 @@ func DownloadAppendBlob(
 		return nil, err
 	}
 
-	common, err := downloadCommon(ctx, client.BlobClient(), name)
+	common, props, err := downloadCommon(ctx, client.BlobClient(), name)
 	if err != nil {
 		return nil, err
 	}
 
+	blob := &AppendBlob{
+		CommonBlob: *common,
+		Fragments:  make(AppendFragmentList, 0, 1),
+	}
+
+	if props.BlobCommittedBlockCount != nil {
+		blob.CommittedBlocks = *props.BlobCommittedBlockCount
+	}
+
 	offset := uint64(0)
-	size := common.ContentSize
 
 	if prev != nil {
-		offset = prev.Common().ContentSize
-		size -= offset
+		unchanged, err := prev.isPrefixOf(ctx, client.BlobClient(), blob)
+		if err != nil {
+			return nil, err
+		}
+
+		if unchanged {
+			blob.Fragments = append(blob.Fragments, prev.Fragments...)
+			offset = prev.ContentSize
+		} else {
+			log.Printf("Warning: Can't confirm that %q was only appended to, downloading it fully", name)
+		}
 	}
 
-	fb, err := repo.DownloadBlobRangeAsFileBuf(ctx, client.BlobClient(), offset, size)
+	if offset < blob.ContentSize {
+		chunks, _, err := repo.DownloadBlobRange(ctx, client.BlobClient(), offset, blob.ContentSize-offset)
+		if err != nil {
+			return nil, err
+		}
+
+		blob.Fragments = append(blob.Fragments, &AppendBlobFragment{
+			Offset:  offset,
+			Content: chunks,
+		})
+	}
+
+	blob.TailMD5, err = downloadTailMD5(ctx, client.BlobClient(), blob.ContentSize)
 	if err != nil {
 		return nil, err
 	}
 
-	blob := &AppendBlob{
-		CommonBlob: *common,
-		Fragments: &AppendBlobFragment{
-			LastChunk: fb,
-			Previous:  nil,
-		},
+	return blob, nil
+}
+
+// isPrefixOf checks that the newer version of the blob starts with the same data as this one
+func (a *AppendBlob) isPrefixOf(ctx context.Context, client *azblob.Client, newer *AppendBlob) (bool, error) {
+	// Backups made before the tail was recorded can't be verified
+	if a.TailMD5 == nil {
+		return false, nil
 	}
 
-	if prev != nil {
-		blob.Fragments.Previous = prev.Fragments
+	if newer.ContentSize < a.ContentSize || newer.CommittedBlocks < a.CommittedBlocks {
+		return false, nil
 	}
 
-	return blob, nil
+	tailMD5, err := downloadTailMD5(ctx, client, a.ContentSize)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(tailMD5, a.TailMD5), nil
+}
+
+// downloadTailMD5 hashes the last appendTailSize bytes of the blob before the given offset
+func downloadTailMD5(ctx context.Context, client *azblob.Client, end uint64) ([]byte, error) {
+	size := min(end, appendTailSize)
+	hash := md5.New()
+
+	if size > 0 {
+		stream, err := client.DownloadStream(ctx, &azblob.DownloadStreamOptions{
+			Range: azblob.HTTPRange{
+				Offset: int64(end - size),
+				Count:  int64(size),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer stream.Body.Close()
+
+		_, err = io.Copy(hash, stream.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hash.Sum(nil), nil
 }
 
 func (*AppendBlob) Type() azcontainer.BlobType {
@@ -75,19 +193,65 @@ func (a *AppendBlob) Common() *CommonBlob {
 }
 
 func (a *AppendBlob) Export(ctx context.Context, repo *Repository) io.ReadCloser {
-	fragments := make([]io.ReadCloser, 0)
+	fragments := make([]io.ReadCloser, 0, len(a.Fragments))
 
-	for cur := a.Fragments; cur != nil; cur = cur.Previous {
-		fragments = append(fragments, cur.LastChunk.LazyReader(repo.LocalPath))
+	for _, fragment := range a.Fragments {
+		fragments = append(fragments, fragment.Content.LazyReader(repo))
 	}
 
 	return ChainReader(fragments...)
 }
 
+func (a *AppendBlob) FileBufs() iter.Seq[*FileBuf] {
+	return func(yield func(*FileBuf) bool) {
+		for _, fragment := range a.Fragments {
+			for fb := range fragment.Content.All() {
+				if !yield(fb) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *AppendBlob) Restore(ctx context.Context, repo *Repository, contClient *azcontainer.Client, conditions *azblob.AccessConditions) error {
+	client := contClient.NewAppendBlobClient(a.Name)
+
+	_, err := client.Create(ctx, &appendblob.CreateOptions{
+		HTTPHeaders:      a.restoreHeaders(),
+		Metadata:         a.Metadata,
+		AccessConditions: conditions,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, fragment := range a.Fragments {
+		reader := fragment.Content.LazyReader(repo)
+
+		err = forEachPiece(reader, func(offset uint64, piece []byte) error {
+			_, err := client.AppendBlock(ctx, streaming.NopCloser(bytes.NewReader(piece)), &appendblob.AppendBlockOptions{
+				AppendPositionAccessConditions: &appendblob.AppendPositionAccessConditions{
+					AppendPosition: azure.Addressof(int64(fragment.Offset + offset)),
+				},
+			})
+			return err
+		})
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (a *AppendBlob) ShallowClone() Blob {
 	return &AppendBlob{
-		CommonBlob: a.CommonBlob,
-		Fragments:  a.Fragments,
+		CommonBlob:      a.CommonBlob,
+		CommittedBlocks: a.CommittedBlocks,
+		TailMD5:         a.TailMD5,
+		Fragments:       a.Fragments,
 	}
 }
 
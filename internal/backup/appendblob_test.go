@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// appendView is what matters about an append blob fragment for comparison
+type appendView struct {
+	Offset uint64
+	Chunks []string
+}
+
+func viewAppendFragments(fragments AppendFragmentList) []appendView {
+	result := make([]appendView, len(fragments))
+	for i, fragment := range fragments {
+		result[i].Offset = fragment.Offset
+		for _, chunk := range fragment.Content {
+			result[i].Chunks = append(result[i].Chunks, chunk.ID)
+		}
+	}
+	return result
+}
+
+func TestAppendFragmentListJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []appendView
+	}{
+		{
+			"list",
+			`[{"Offset": 0, "Content": [{"ID": "a", "Size": 10}]}, {"Offset": 10, "Content": [{"ID": "b", "Size": 5}]}]`,
+			[]appendView{{0, []string{"a"}}, {10, []string{"b"}}},
+		},
+		{
+			"empty list",
+			`[]`,
+			[]appendView{},
+		},
+		{
+			"legacy single",
+			`{"LastChunk": [{"ID": "a", "Size": 10}, {"ID": "b", "Size": 20}], "Previous": null}`,
+			[]appendView{{0, []string{"a", "b"}}},
+		},
+		{
+			// Older snapshots link the newest fragment to the previous ones
+			"legacy chain",
+			`{"LastChunk": [{"ID": "c", "Size": 1}], "Previous": {"LastChunk": [{"ID": "b", "Size": 5}], "Previous": {"LastChunk": [{"ID": "a", "Size": 10}, {"ID": "a2", "Size": 3}]}}}`,
+			[]appendView{{0, []string{"a", "a2"}}, {13, []string{"b"}}, {18, []string{"c"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fragments AppendFragmentList
+			err := json.Unmarshal([]byte(test.data), &fragments)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := viewAppendFragments(fragments)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	// Converted fragments are saved in the current format
+	var fragments AppendFragmentList
+	err := json.Unmarshal([]byte(tests[3].data), &fragments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(fragments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var again AppendFragmentList
+	err = json.Unmarshal(data, &again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := viewAppendFragments(again); !reflect.DeepEqual(got, tests[3].want) {
+		t.Errorf("round trip: got %+v, want %+v", got, tests[3].want)
+	}
+}
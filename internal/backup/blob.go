@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"iter"
 	"time"
 
 	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
@@ -16,6 +17,10 @@ type Blob interface {
 	Common() *CommonBlob
 	ShallowClone() Blob
 	Export(ctx context.Context, repo *Repository) io.ReadCloser
+	// Restore recreates the blob in a container. The blob is only created if the conditions hold, when given
+	Restore(ctx context.Context, repo *Repository, client *azcontainer.Client, conditions *azblob.AccessConditions) error
+	// FileBufs iterates over all the FileBufs the blob's content is made of
+	FileBufs() iter.Seq[*FileBuf]
 	// TODO: Save/Load metadata to disk; restore references to fragments?
 }
 
@@ -92,14 +97,16 @@ func DownloadBlob(
 	panic(fmt.Sprintf("invalid blob type: %v", blobType))
 }
 
+// downloadCommon fetches the properties shared by all blob types.
+// The raw properties are returned as well, for the type-specific ones.
 func downloadCommon(
 	ctx context.Context,
 	client *azblob.Client,
 	name string,
-) (*CommonBlob, error) {
+) (*CommonBlob, *azblob.GetPropertiesResponse, error) {
 	props, err := client.GetProperties(ctx, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	result := &CommonBlob{
@@ -115,7 +122,7 @@ func downloadCommon(
 
 	stream, err := client.DownloadStream(ctx, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// We don't actually care about the body at all,
 	// might as well close it right away to not waste the traffic
@@ -123,5 +130,5 @@ func downloadCommon(
 
 	result.ContentSize = uint64(*stream.ContentLength)
 
-	return result, nil
+	return result, &props, nil
 }
@@ -2,8 +2,11 @@ package backup
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"iter"
 
+	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/abel1502/mipt-kp-m-test/internal/azure"
@@ -18,8 +21,8 @@ type BlockBlob struct {
 type BlockBlobFragment struct {
 	// ID is the base64-encoded block ID
 	ID string
-	// Content is the block data
-	Content *FileBuf
+	// Content is the block data, split into chunks
+	Content ChunkList
 }
 
 func DownloadBlockBlob(
@@ -40,7 +43,7 @@ func DownloadBlockBlob(
 		return nil, err
 	}
 
-	commonBlob, err := downloadCommon(ctx, client.BlobClient(), name)
+	commonBlob, _, err := downloadCommon(ctx, client.BlobClient(), name)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +60,7 @@ func DownloadBlockBlob(
 
 	blob := &BlockBlob{
 		CommonBlob: *commonBlob,
-		Fragments:  make([]*BlockBlobFragment, 0, len(blockList.CommittedBlocks)),
+		Fragments:  make([]*BlockBlobFragment, len(blockList.CommittedBlocks)),
 	}
 
 	knownFragments := make(map[string]*BlockBlobFragment)
@@ -69,25 +72,34 @@ func DownloadBlockBlob(
 		}
 	}
 
+	offsets := make([]uint64, len(blockList.CommittedBlocks))
 	offset := uint64(0)
+	for i, block := range blockList.CommittedBlocks {
+		offsets[i] = offset
+		offset += uint64(*block.Size)
+	}
+
+	err = repo.forEachRange(ctx, len(blockList.CommittedBlocks), func(ctx context.Context, i int) error {
+		block := blockList.CommittedBlocks[i]
 
-	for _, block := range blockList.CommittedBlocks {
 		fragment, ok := knownFragments[*block.Name]
 		if !ok {
-			fb, err := repo.DownloadBlobRangeAsFileBuf(ctx, client.BlobClient(), offset, uint64(*block.Size))
+			chunks, _, err := repo.DownloadBlobRange(ctx, client.BlobClient(), offsets[i], uint64(*block.Size))
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			fragment = &BlockBlobFragment{
 				ID:      *block.Name,
-				Content: fb,
+				Content: chunks,
 			}
 		}
 
-		blob.Fragments = append(blob.Fragments, fragment)
-
-		offset += fragment.Content.Size
+		blob.Fragments[i] = fragment
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return blob, nil
@@ -105,12 +117,136 @@ func (b *BlockBlob) Export(ctx context.Context, repo *Repository) io.ReadCloser
 	fragments := make([]io.ReadCloser, 0, len(b.Fragments))
 
 	for _, fragment := range b.Fragments {
-		fragments = append(fragments, fragment.Content.LazyReader(repo.LocalPath))
+		fragments = append(fragments, fragment.Content.LazyReader(repo))
 	}
 
 	return ChainReader(fragments...)
 }
 
+func (b *BlockBlob) FileBufs() iter.Seq[*FileBuf] {
+	return func(yield func(*FileBuf) bool) {
+		for _, fragment := range b.Fragments {
+			for fb := range fragment.Content.All() {
+				if !yield(fb) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *BlockBlob) Restore(ctx context.Context, repo *Repository, contClient *azcontainer.Client, conditions *azblob.AccessConditions) error {
+	client := contClient.NewBlockBlobClient(b.Name)
+
+	// Blobs uploaded in a single request have no real blocks
+	if len(b.Fragments) == 0 || (len(b.Fragments) == 1 && b.Fragments[0].ID == "") {
+		reader := b.Export(ctx, repo)
+		defer reader.Close()
+
+		_, err := client.UploadStream(ctx, reader, &blockblob.UploadStreamOptions{
+			HTTPHeaders:      b.restoreHeaders(),
+			Metadata:         b.Metadata,
+			AccessConditions: conditions,
+		})
+		return err
+	}
+
+	blockIDs := make([]string, 0, len(b.Fragments))
+	staged := make(map[string]struct{})
+
+	for _, fragment := range b.Fragments {
+		blockIDs = append(blockIDs, fragment.ID)
+
+		if _, ok := staged[fragment.ID]; ok {
+			continue
+		}
+
+		// Blocks may be up to 4000 MiB, so they are streamed rather than buffered
+		body := &rewindableReader{
+			open: func() io.ReadCloser {
+				return fragment.Content.LazyReader(repo)
+			},
+			size: int64(fragment.Content.Size()),
+		}
+		_, err := client.StageBlock(ctx, fragment.ID, body, nil)
+		body.Close()
+		if err != nil {
+			return err
+		}
+
+		staged[fragment.ID] = struct{}{}
+	}
+
+	_, err := client.CommitBlockList(ctx, blockIDs, &blockblob.CommitBlockListOptions{
+		HTTPHeaders:      b.restoreHeaders(),
+		Metadata:         b.Metadata,
+		AccessConditions: conditions,
+	})
+	return err
+}
+
+// rewindableReader streams data of a known size as a request body.
+// Seeking only supports what the SDK needs: finding the size and rewinding for a retry,
+// which starts reading from scratch
+type rewindableReader struct {
+	open   func() io.ReadCloser
+	size   int64
+	reader io.ReadCloser
+	offset int64
+}
+
+func (r *rewindableReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.reader == nil {
+		r.reader = r.open()
+	}
+
+	n, err := r.reader.Read(p[:min(int64(len(p)), r.size-r.offset)])
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (r *rewindableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+
+	switch offset {
+	case r.offset:
+	case 0:
+		r.Close()
+		r.offset = 0
+	case r.size:
+		r.Close()
+		r.offset = r.size
+	default:
+		return r.offset, fmt.Errorf("unsupported seek to %v of %v", offset, r.size)
+	}
+
+	return r.offset, nil
+}
+
+func (r *rewindableReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+
+	// Note: readers of the chunks that were never opened fail to close, which doesn't matter here
+	_ = r.reader.Close()
+	r.reader = nil
+	return nil
+}
+
 func (b *BlockBlob) ShallowClone() Blob {
 	return &BlockBlob{
 		CommonBlob: b.CommonBlob,
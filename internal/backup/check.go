@@ -0,0 +1,255 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+type CheckOptions struct {
+	// ReadData reads all FileBufs back, verifying their hashes and the blob MD5s
+	ReadData bool
+	// ReadDataSubset is the percentage of FileBufs to read back, if ReadData isn't set
+	ReadDataSubset float64
+}
+
+type CheckErrorKind string
+
+const (
+	CheckConfig       CheckErrorKind = "config"
+	CheckSnapshot     CheckErrorKind = "snapshot"
+	CheckMissing      CheckErrorKind = "missing"
+	CheckSize         CheckErrorKind = "size"
+	CheckUnreadable   CheckErrorKind = "unreadable"
+	CheckHash         CheckErrorKind = "hash"
+	CheckBlobChecksum CheckErrorKind = "blob_checksum"
+)
+
+type CheckError struct {
+	Kind CheckErrorKind `json:"kind"`
+	// Object is the file, FileBuf ID or blob name the error relates to
+	Object  string `json:"object"`
+	Message string `json:"message"`
+}
+
+type CheckReport struct {
+	Snapshots     int          `json:"snapshots"`
+	FileBufs      int          `json:"filebufs"`
+	FileBufsRead  int          `json:"filebufs_read"`
+	BlobsVerified int          `json:"blobs_verified"`
+	Errors        []CheckError `json:"errors"`
+}
+
+func (c *CheckReport) OK() bool {
+	return len(c.Errors) == 0
+}
+
+func (c *CheckReport) addError(kind CheckErrorKind, object string, format string, args ...any) {
+	c.Errors = append(c.Errors, CheckError{
+		Kind:    kind,
+		Object:  object,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Check verifies the repository structure and, optionally, the stored data
+func (r *Repository) Check(ctx context.Context, options CheckOptions) *CheckReport {
+	report := &CheckReport{
+		Snapshots: len(r.Revisions),
+		Errors:    make([]CheckError, 0),
+	}
+
+	if r.ContainerURL == "" {
+		report.addError(CheckConfig, "info.json", "container URL is missing")
+	}
+	if err := r.Chunking.Validate(); err != nil {
+		report.addError(CheckConfig, "info.json", "%v", err)
+	}
+	if err := r.Compression.Validate(); err != nil {
+		report.addError(CheckConfig, "info.json", "%v", err)
+	}
+	if err := r.ContentHash.Validate(); err != nil {
+		report.addError(CheckConfig, "info.json", "%v", err)
+	}
+
+	for indexFile, err := range r.brokenSnapshots {
+		report.addError(CheckSnapshot, indexFile, "failed to load: %v", err)
+	}
+
+	// Archived FileBufs would only fail to be read one by one
+	archived := r.archived(backend.KindData)
+	if archived && (options.ReadData || options.ReadDataSubset > 0) {
+		report.addError(CheckUnreadable, r.Backend.Location(), "%v, not reading the data back", fail.ErrArchived)
+	}
+
+	checked := make(map[string]struct{})
+	// badFileBufs are the FileBufs that failed to be read back
+	badFileBufs := make(map[string]bool)
+
+	for _, snapshot := range r.Revisions {
+		for _, blob := range snapshot.Blobs {
+			for fb := range blob.FileBufs() {
+				if _, ok := checked[fb.ID]; ok {
+					continue
+				}
+
+				checked[fb.ID] = struct{}{}
+				report.FileBufs++
+
+				read := !archived && (options.ReadData || rand.Float64()*100 < options.ReadDataSubset)
+
+				if !r.checkFileBuf(report, fb, read) {
+					badFileBufs[fb.ID] = true
+				}
+				if read {
+					report.FileBufsRead++
+				}
+			}
+		}
+	}
+
+	if !options.ReadData || archived {
+		return report
+	}
+
+	// Blobs unchanged between revisions are only reconstructed once
+	verified := make(map[string]struct{})
+
+	for _, snapshot := range r.Revisions {
+		for _, blob := range snapshot.Blobs {
+			key := blobChecksumKey(blob)
+			if _, ok := verified[key]; ok {
+				continue
+			}
+			verified[key] = struct{}{}
+
+			r.checkBlobChecksum(ctx, report, snapshot, blob, badFileBufs)
+		}
+	}
+
+	return report
+}
+
+// checkFileBuf verifies a single FileBuf, reporting whether it's fine
+func (r *Repository) checkFileBuf(report *CheckReport, fb *FileBuf, read bool) bool {
+	info, err := r.Backend.Stat(backend.KindData, fb.ID)
+	if errors.Is(err, fs.ErrNotExist) {
+		report.addError(CheckMissing, fb.ID, "referenced FileBuf does not exist")
+		return false
+	}
+	if err != nil {
+		report.addError(CheckUnreadable, fb.ID, "%v", err)
+		return false
+	}
+
+	// FileBufs predating compression don't record the stored size,
+	// but unencrypted ones were stored as is
+	expectedSize := fb.StoredSize
+	if expectedSize == 0 && r.Encryption == nil {
+		expectedSize = fb.Size
+	}
+
+	if expectedSize != 0 && uint64(info.Size) != expectedSize {
+		report.addError(CheckSize, fb.ID, "stored size is %v bytes, want %v", info.Size, expectedSize)
+		return false
+	}
+
+	if !read {
+		return true
+	}
+
+	reader, err := r.openChunk(fb)
+	if err != nil {
+		report.addError(CheckUnreadable, fb.ID, "%v", err)
+		return false
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		report.addError(CheckUnreadable, fb.ID, "%v", err)
+		return false
+	}
+
+	if uint64(len(data)) != fb.Size {
+		report.addError(CheckSize, fb.ID, "content size is %v bytes, want %v", len(data), fb.Size)
+		return false
+	}
+
+	id, err := r.chunkID(data)
+	if err != nil {
+		report.addError(CheckUnreadable, fb.ID, "%v", err)
+		return false
+	}
+
+	if hex.EncodeToString(id) != fb.ID {
+		report.addError(CheckHash, fb.ID, "content hash is %x", id)
+		return false
+	}
+
+	return true
+}
+
+// blobChecksumKey identifies a blob revision by its name, its MD5 and the FileBufs it's reconstructed from
+func blobChecksumKey(blob Blob) string {
+	common := blob.Common()
+
+	var key strings.Builder
+	key.WriteString(common.Name)
+	key.WriteByte(0)
+	key.WriteString(hex.EncodeToString(common.ContentMD5))
+	for fb := range blob.FileBufs() {
+		key.WriteByte(0)
+		key.WriteString(fb.ID)
+	}
+
+	return key.String()
+}
+
+// checkBlobChecksum reconstructs the blob and compares its MD5 against the one reported by Azure
+func (r *Repository) checkBlobChecksum(ctx context.Context, report *CheckReport, snapshot Snapshot, blob Blob, badFileBufs map[string]bool) {
+	common := blob.Common()
+	object := fmt.Sprintf("%v:%v", snapshot.ID, common.Name)
+
+	if common.ContentMD5 == nil {
+		return
+	}
+
+	for fb := range blob.FileBufs() {
+		if badFileBufs[fb.ID] {
+			// Already reported
+			return
+		}
+	}
+
+	reader := blob.Export(ctx, r)
+	defer reader.Close()
+
+	hash := md5.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		report.addError(CheckUnreadable, object, "%v", err)
+		return
+	}
+
+	report.BlobsVerified++
+
+	if uint64(size) != common.ContentSize {
+		report.addError(CheckBlobChecksum, object, "reconstructed size is %v bytes, want %v", size, common.ContentSize)
+		return
+	}
+
+	if !bytes.Equal(hash.Sum(nil), common.ContentMD5) {
+		report.addError(CheckBlobChecksum, object, "reconstructed MD5 is %x, want %x", hash.Sum(nil), common.ContentMD5)
+	}
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression identifies the algorithm a FileBuf is compressed with
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionZstd Compression = "zstd"
+	CompressionLZ4  Compression = "lz4"
+)
+
+func (c Compression) Validate() error {
+	switch c {
+	case CompressionNone, CompressionZstd, CompressionLZ4:
+		return nil
+	}
+
+	return fmt.Errorf("unknown compression algorithm: %q", c)
+}
+
+// entropyThreshold is the byte entropy (in bits per byte) above which
+// data is assumed to be already compressed or encrypted
+const entropyThreshold = 7.5
+
+// entropySampleSize is how much of a chunk is inspected by the entropy check
+const entropySampleSize = 64 * 1024
+
+// Note: the choice of algorithm must be a deterministic function of the data,
+// since a deduplicated chunk keeps the format it was first stored with.
+func compress(algorithm Compression, data []byte) (Compression, []byte, error) {
+	if algorithm == CompressionNone || len(data) == 0 || byteEntropy(data[:min(len(data), entropySampleSize)]) > entropyThreshold {
+		return CompressionNone, data, nil
+	}
+
+	var compressed []byte
+
+	switch algorithm {
+	case CompressionZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return "", nil, err
+		}
+		compressed = encoder.EncodeAll(data, nil)
+
+	case CompressionLZ4:
+		compressed = make([]byte, lz4.CompressBlockBound(len(data)))
+		n, err := lz4.CompressBlock(data, compressed, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		// n == 0 means the data is incompressible
+		if n == 0 {
+			return CompressionNone, data, nil
+		}
+		compressed = compressed[:n]
+
+	default:
+		return "", nil, algorithm.Validate()
+	}
+
+	if len(compressed) >= len(data) {
+		return CompressionNone, data, nil
+	}
+
+	return algorithm, compressed, nil
+}
+
+func decompress(algorithm Compression, data []byte, size uint64) ([]byte, error) {
+	switch algorithm {
+	case "", CompressionNone:
+		return data, nil
+
+	case CompressionZstd:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, make([]byte, 0, size))
+
+	case CompressionLZ4:
+		result := make([]byte, size)
+		n, err := lz4.UncompressBlock(data, result)
+		if err != nil {
+			return nil, err
+		}
+		return result[:n], nil
+	}
+
+	return nil, algorithm.Validate()
+}
+
+// byteEntropy computes the Shannon entropy of the data in bits per byte
+func byteEntropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	result := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+
+		p := float64(count) / float64(len(data))
+		result -= p * math.Log2(p)
+	}
+
+	return result
+}
+
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+})
+
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+})
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/azure"
+)
+
+// ConsistencyMode decides what is done about blobs modified while the online snapshot was being taken
+type ConsistencyMode string
+
+const (
+	// ConsistencyNone skips the check altogether
+	ConsistencyNone ConsistencyMode = "none"
+	// ConsistencyDetect only flags the modified blobs in the snapshot
+	ConsistencyDetect ConsistencyMode = "detect"
+	// ConsistencyRetry re-snapshots the modified blobs until they are stable
+	ConsistencyRetry ConsistencyMode = "retry"
+)
+
+func (m ConsistencyMode) Validate() error {
+	switch m {
+	case ConsistencyNone, ConsistencyDetect, ConsistencyRetry:
+		return nil
+	default:
+		return fmt.Errorf("unknown consistency mode: %q", m)
+	}
+}
+
+// ConsistencyOutcome is the result of the consistency check
+type ConsistencyOutcome string
+
+const (
+	// ConsistencyUnchecked means that the check was disabled
+	ConsistencyUnchecked ConsistencyOutcome = "unchecked"
+	// ConsistencyConsistent means that no blob was modified while the snapshot was being taken
+	ConsistencyConsistent ConsistencyOutcome = "consistent"
+	// ConsistencyStabilized means that the modified blobs stopped changing after being re-snapshotted
+	ConsistencyStabilized ConsistencyOutcome = "stabilized"
+	// ConsistencyInconsistent means that some blobs may not correspond to the same point in time
+	ConsistencyInconsistent ConsistencyOutcome = "inconsistent"
+)
+
+// consistencyRetryDelay is the pause between re-snapshot rounds, multiplied by the round number
+const consistencyRetryDelay = time.Second
+
+// ConsistencyReport records the consistency check performed when the snapshot was taken
+type ConsistencyReport struct {
+	Mode    ConsistencyMode    `json:"mode"`
+	Outcome ConsistencyOutcome `json:"outcome"`
+	// Rounds is the number of re-snapshot rounds performed
+	Rounds int `json:"rounds,omitempty"`
+	// Modified lists the blobs that may be inconsistent with the rest of the snapshot
+	Modified []string `json:"modified,omitempty"`
+}
+
+// checkConsistency looks for blobs modified after the online snapshot was started, possibly re-snapshotting them.
+// Returns the names of the blobs deleted before they could be re-snapshotted, which are left out of the online snapshot
+func checkConsistency(ctx context.Context, onlineSnapshot *azure.ContainerSnapshot, mode ConsistencyMode, retries int) (*ConsistencyReport, []string, error) {
+	report := &ConsistencyReport{
+		Mode:    mode,
+		Outcome: ConsistencyUnchecked,
+	}
+
+	if mode == ConsistencyNone {
+		return report, nil, nil
+	}
+
+	modified := onlineSnapshot.Modified()
+	if len(modified) == 0 {
+		report.Outcome = ConsistencyConsistent
+		return report, nil, nil
+	}
+
+	var deleted []string
+	if mode == ConsistencyRetry {
+		for len(modified) > 0 && report.Rounds < retries {
+			report.Rounds++
+
+			select {
+			case <-time.After(consistencyRetryDelay * time.Duration(report.Rounds)):
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+
+			var gone []string
+			var err error
+			modified, gone, err = onlineSnapshot.Resnapshot(ctx, modified)
+			if err != nil {
+				return nil, nil, err
+			}
+			deleted = append(deleted, gone...)
+		}
+
+		if len(modified) == 0 {
+			report.Outcome = ConsistencyStabilized
+			return report, deleted, nil
+		}
+	}
+
+	report.Outcome = ConsistencyInconsistent
+	for _, i := range modified {
+		report.Modified = append(report.Modified, onlineSnapshot.Blobs[i].Name)
+	}
+
+	fmt.Printf("!! %v blob(s) were modified while the snapshot was being taken\n", len(report.Modified))
+
+	return report, deleted, nil
+}
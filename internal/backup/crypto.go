@@ -0,0 +1,231 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+	"golang.org/x/crypto/scrypt"
+)
+
+// EncryptionConfig is the repository-wide encryption setup, stored in info.json.
+// The master key itself is only stored wrapped with a key derived from a passphrase or a key file.
+type EncryptionConfig struct {
+	// KDF is the key derivation function for the wrapping key. Only "scrypt" is supported
+	KDF  string `json:"kdf"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	// WrappedKey is the master key, sealed with the derived wrapping key
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// chunkMagic prefixes every encrypted FileBuf on disk
+var chunkMagic = []byte("ABKE\x01")
+
+const masterKeySize = 32
+
+// keyring holds the unlocked keys of a repository
+type keyring struct {
+	// master wraps the per-chunk convergent keys
+	master []byte
+	// id is used to compute FileBuf IDs as keyed hashes of the plaintext
+	id []byte
+	// content is used to derive the convergent content keys as keyed hashes of the plaintext
+	content []byte
+}
+
+func newEncryption(secret []byte) (*EncryptionConfig, *keyring, error) {
+	master := make([]byte, masterKeySize)
+	_, err := rand.Read(master)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &EncryptionConfig{
+		KDF:  "scrypt",
+		Salt: make([]byte, 16),
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+	}
+
+	_, err = rand.Read(config.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrappingKey, err := config.wrappingKey(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config.WrappedKey, err = sealRandom(wrappingKey, master)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := newKeyring(master)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return config, keys, nil
+}
+
+func (c *EncryptionConfig) wrappingKey(secret []byte) ([]byte, error) {
+	if c.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function: %q", c.KDF)
+	}
+
+	return scrypt.Key(secret, c.Salt, c.N, c.R, c.P, masterKeySize)
+}
+
+func (c *EncryptionConfig) unlock(secret []byte) (*keyring, error) {
+	wrappingKey, err := c.wrappingKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	master, err := openRandom(wrappingKey, c.WrappedKey)
+	if err != nil {
+		return nil, fail.ErrWrongKey
+	}
+
+	return newKeyring(master)
+}
+
+func newKeyring(master []byte) (*keyring, error) {
+	id, err := hkdf.Key(sha256.New, master, nil, "filebuf id", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := hkdf.Key(sha256.New, master, nil, "filebuf content key", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyring{
+		master:  master,
+		id:      id,
+		content: content,
+	}, nil
+}
+
+// chunkID is the keyed hash of the plaintext. Unlike a plain hash,
+// it doesn't let someone without the key confirm a guess about the contents.
+func (k *keyring) chunkID(data []byte) []byte {
+	mac := hmac.New(sha256.New, k.id)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// contentKey is the convergent key of a chunk. Being keyed, it is only convergent within the repository,
+// so that encrypting a guess doesn't confirm it by matching the stored ciphertext
+func (k *keyring) contentKey(data []byte) []byte {
+	mac := hmac.New(sha256.New, k.content)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// seal encrypts a chunk with a convergent key derived from its content.
+// The ciphertext part is deterministic, so identical chunks are stored identically.
+// Layout: magic | wrapped content key | ciphertext
+func (k *keyring) seal(data []byte) ([]byte, error) {
+	contentKey := k.contentKey(data)
+
+	wrappedKey, err := sealRandom(k.master, contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 0, len(chunkMagic)+len(wrappedKey)+len(data)+aead.Overhead())
+	result = append(result, chunkMagic...)
+	result = append(result, wrappedKey...)
+	// Each content key only ever encrypts one plaintext, so a fixed nonce is fine here
+	result = aead.Seal(result, make([]byte, aead.NonceSize()), data, nil)
+
+	return result, nil
+}
+
+func (k *keyring) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, chunkMagic) {
+		return nil, errors.New("not an encrypted chunk")
+	}
+	data = data[len(chunkMagic):]
+
+	wrappedKeySize := sealedSize(masterKeySize)
+	if len(data) < wrappedKeySize {
+		return nil, errors.New("truncated encrypted chunk")
+	}
+
+	contentKey, err := openRandom(k.master, data[:wrappedKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, make([]byte, aead.NonceSize()), data[wrappedKeySize:], nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealedSize is the size of sealRandom's output for a plaintext of the given size
+func sealedSize(size int) int {
+	// AES-GCM: 12-byte nonce, 16-byte tag
+	return 12 + size + 16
+}
+
+// sealRandom encrypts data with a random nonce, which is prepended to the result
+func sealRandom(key []byte, data []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func openRandom(key []byte, data []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("truncated sealed data")
+	}
+
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+func TestSealOpen(t *testing.T) {
+	config, keys, err := newEncryption([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"short", []byte("hello")},
+		{"long", bytes.Repeat([]byte("0123456789abcdef"), 64*1024)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sealed, err := keys.seal(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.HasPrefix(sealed, chunkMagic) {
+				t.Error("sealed chunk doesn't start with the magic")
+			}
+			if len(test.data) > 0 && bytes.Contains(sealed, test.data) {
+				t.Error("sealed chunk contains the plaintext")
+			}
+
+			opened, err := keys.open(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, test.data) {
+				t.Error("opened chunk differs from the original")
+			}
+
+			// The keys unwrapped from the config have to open the chunk just as well
+			unlocked, err := config.unlock([]byte("passphrase"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			opened, err = unlocked.open(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, test.data) {
+				t.Error("chunk opened with the unlocked keys differs from the original")
+			}
+		})
+	}
+}
+
+func TestOpenCorrupted(t *testing.T) {
+	_, keys, err := newEncryption([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := keys.seal([]byte("some chunk contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no magic", sealed[len(chunkMagic):]},
+		{"truncated", sealed[:len(chunkMagic)+4]},
+		{"flipped bit", flipped},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := keys.open(test.data)
+			if err == nil {
+				t.Error("corrupted chunk opened without an error")
+			}
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	config, keys, err := newEncryption([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = config.unlock([]byte("not the passphrase"))
+	if !errors.Is(err, fail.ErrWrongKey) {
+		t.Errorf("unlock with a wrong passphrase: got %v, want %v", err, fail.ErrWrongKey)
+	}
+
+	// Chunks of another repository can't be opened either, even though their content keys are convergent
+	_, otherKeys, err := newEncryption([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := otherKeys.seal([]byte("some chunk contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = keys.open(sealed)
+	if err == nil {
+		t.Error("chunk of another repository opened without an error")
+	}
+
+	if bytes.Equal(keys.chunkID([]byte("data")), otherKeys.chunkID([]byte("data"))) {
+		t.Error("chunk IDs don't depend on the repository keys")
+	}
+}
+
+// TestConvergence checks that a repository stores identical chunks identically,
+// while another one can't reproduce its ciphertext to confirm a guess about the contents
+func TestConvergence(t *testing.T) {
+	_, keys, err := newEncryption([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKeys, err := newEncryption([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("some chunk contents")
+	body := func(keys *keyring) []byte {
+		t.Helper()
+
+		sealed, err := keys.seal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed[len(chunkMagic)+sealedSize(masterKeySize):]
+	}
+
+	if !bytes.Equal(body(keys), body(keys)) {
+		t.Error("the same chunk is encrypted differently within a repository")
+	}
+	if bytes.Equal(body(keys), body(otherKeys)) {
+		t.Error("the same chunk is encrypted identically in repositories with different master keys")
+	}
+}
@@ -0,0 +1,341 @@
+package backup
+
+import (
+	"bytes"
+	"cmp"
+	"maps"
+	"slices"
+	"strings"
+
+	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+type DiffKind string
+
+const (
+	DiffAdded     DiffKind = "added"
+	DiffDeleted   DiffKind = "deleted"
+	DiffRecreated DiffKind = "recreated"
+	DiffModified  DiffKind = "modified"
+)
+
+// SnapshotDiff is the set of changes between two snapshots
+type SnapshotDiff struct {
+	From  string     `json:"from"`
+	To    string     `json:"to"`
+	Blobs []BlobDiff `json:"blobs"`
+}
+
+// BlobDiff describes how a single blob changed
+type BlobDiff struct {
+	Name    string               `json:"name"`
+	Kind    DiffKind             `json:"kind"`
+	Type    azcontainer.BlobType `json:"type"`
+	OldSize uint64               `json:"old_size"`
+	NewSize uint64               `json:"new_size"`
+	// ContentChanged and MetadataChanged are only set for modified blobs
+	ContentChanged  bool `json:"content_changed,omitempty"`
+	MetadataChanged bool `json:"metadata_changed,omitempty"`
+	// Blocks, Pages and AppendedBytes are set for modified blobs of the corresponding type
+	Blocks        *BlockDiff `json:"blocks,omitempty"`
+	Pages         *PageDiff  `json:"pages,omitempty"`
+	AppendedBytes uint64     `json:"appended_bytes,omitempty"`
+}
+
+type BlockDiff struct {
+	// Added and Removed are the IDs of the blocks that appeared or disappeared
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+	AddedBytes   uint64   `json:"added_bytes"`
+	RemovedBytes uint64   `json:"removed_bytes"`
+}
+
+type PageRange struct {
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+type PageDiff struct {
+	// Changed are the new page ranges with different content
+	Changed []PageRange `json:"changed"`
+	// Cleared are the old page ranges no longer covered by any page
+	Cleared []PageRange `json:"cleared"`
+}
+
+// Summary counts the changes of each kind
+func (d *SnapshotDiff) Summary() map[DiffKind]int {
+	result := make(map[DiffKind]int)
+	for _, blob := range d.Blobs {
+		result[blob.Kind]++
+	}
+
+	return result
+}
+
+// Diff compares this (older) snapshot with a newer one
+func (s *Snapshot) Diff(newer *Snapshot) *SnapshotDiff {
+	result := &SnapshotDiff{
+		From:  s.ID,
+		To:    newer.ID,
+		Blobs: make([]BlobDiff, 0),
+	}
+
+	oldBlobLookup := make(map[string]Blob, len(s.Blobs))
+	for _, blob := range s.Blobs {
+		oldBlobLookup[blob.Common().Name] = blob
+	}
+
+	for _, newBlob := range newer.Blobs {
+		name := newBlob.Common().Name
+
+		oldBlob, ok := oldBlobLookup[name]
+		if !ok {
+			result.Blobs = append(result.Blobs, BlobDiff{
+				Name:    name,
+				Kind:    DiffAdded,
+				Type:    newBlob.Type(),
+				NewSize: newBlob.Common().ContentSize,
+			})
+			continue
+		}
+		delete(oldBlobLookup, name)
+
+		blobDiff, changed := diffBlob(oldBlob, newBlob)
+		if changed {
+			result.Blobs = append(result.Blobs, blobDiff)
+		}
+	}
+
+	for _, oldBlob := range oldBlobLookup {
+		result.Blobs = append(result.Blobs, BlobDiff{
+			Name:    oldBlob.Common().Name,
+			Kind:    DiffDeleted,
+			Type:    oldBlob.Type(),
+			OldSize: oldBlob.Common().ContentSize,
+		})
+	}
+
+	slices.SortFunc(result.Blobs, func(a, b BlobDiff) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return result
+}
+
+func diffBlob(oldBlob Blob, newBlob Blob) (BlobDiff, bool) {
+	oldCommon, newCommon := oldBlob.Common(), newBlob.Common()
+
+	result := BlobDiff{
+		Name:    newCommon.Name,
+		Type:    newBlob.Type(),
+		OldSize: oldCommon.ContentSize,
+		NewSize: newCommon.ContentSize,
+	}
+
+	if oldBlob.Type() != newBlob.Type() || !oldCommon.Timestamps.CreatedAt.Equal(newCommon.Timestamps.CreatedAt) {
+		result.Kind = DiffRecreated
+		return result, true
+	}
+
+	result.Kind = DiffModified
+	result.ContentChanged = !sameContent(oldBlob, newBlob)
+	result.MetadataChanged = !maps.EqualFunc(oldCommon.Metadata, newCommon.Metadata, func(a, b *string) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+	})
+
+	if !result.ContentChanged && !result.MetadataChanged {
+		return result, false
+	}
+
+	if !result.ContentChanged {
+		return result, true
+	}
+
+	switch newTyped := newBlob.(type) {
+	case *BlockBlob:
+		result.Blocks = diffBlocks(oldBlob.(*BlockBlob), newTyped)
+
+	case *PageBlob:
+		result.Pages = diffPages(oldBlob.(*PageBlob), newTyped)
+
+	case *AppendBlob:
+		if newCommon.ContentSize > oldCommon.ContentSize {
+			result.AppendedBytes = newCommon.ContentSize - oldCommon.ContentSize
+		}
+	}
+
+	return result, true
+}
+
+// sameContent compares the blob contents by MD5 if both have it, or by the FileBufs otherwise
+func sameContent(oldBlob Blob, newBlob Blob) bool {
+	oldCommon, newCommon := oldBlob.Common(), newBlob.Common()
+
+	if oldCommon.ContentSize != newCommon.ContentSize {
+		return false
+	}
+
+	if oldCommon.ContentMD5 != nil && newCommon.ContentMD5 != nil {
+		return bytes.Equal(oldCommon.ContentMD5, newCommon.ContentMD5)
+	}
+
+	oldIDs := make([]string, 0)
+	for fb := range oldBlob.FileBufs() {
+		oldIDs = append(oldIDs, fb.ID)
+	}
+
+	newIDs := make([]string, 0)
+	for fb := range newBlob.FileBufs() {
+		newIDs = append(newIDs, fb.ID)
+	}
+
+	return slices.Equal(oldIDs, newIDs)
+}
+
+func diffBlocks(oldBlob *BlockBlob, newBlob *BlockBlob) *BlockDiff {
+	result := &BlockDiff{
+		Added:   make([]string, 0),
+		Removed: make([]string, 0),
+	}
+
+	oldBlocks := make(map[string]*BlockBlobFragment)
+	for _, fragment := range oldBlob.Fragments {
+		oldBlocks[fragment.ID] = fragment
+	}
+
+	newBlocks := make(map[string]*BlockBlobFragment)
+	for _, fragment := range newBlob.Fragments {
+		newBlocks[fragment.ID] = fragment
+	}
+
+	for _, fragment := range newBlob.Fragments {
+		if _, ok := oldBlocks[fragment.ID]; ok || slices.Contains(result.Added, fragment.ID) {
+			continue
+		}
+
+		result.Added = append(result.Added, fragment.ID)
+		result.AddedBytes += fragment.Content.Size()
+	}
+
+	for _, fragment := range oldBlob.Fragments {
+		if _, ok := newBlocks[fragment.ID]; ok || slices.Contains(result.Removed, fragment.ID) {
+			continue
+		}
+
+		result.Removed = append(result.Removed, fragment.ID)
+		result.RemovedBytes += fragment.Content.Size()
+	}
+
+	return result
+}
+
+func diffPages(oldBlob *PageBlob, newBlob *PageBlob) *PageDiff {
+	result := &PageDiff{
+		Changed: make([]PageRange, 0),
+		Cleared: make([]PageRange, 0),
+	}
+
+	// A byte is unchanged if it comes from the same place of the same chunk as before.
+	// Comparing whole fragments would report the remnants of the punched old ones as changed
+	oldSources := pageSources(oldBlob.Fragments)
+
+	for _, source := range pageSources(newBlob.Fragments) {
+		cursor := source.start
+
+		first, _ := slices.BinarySearchFunc(oldSources, source.start, func(old pageSource, start uint64) int {
+			return cmp.Compare(old.end, start+1)
+		})
+		for _, old := range oldSources[first:] {
+			if old.start >= source.end {
+				break
+			}
+			if old.id != source.id || old.chunkOffset+source.start != source.chunkOffset+old.start {
+				continue
+			}
+
+			start, end := max(old.start, source.start), min(old.end, source.end)
+			if start > cursor {
+				result.Changed = appendPageRange(result.Changed, cursor, start)
+			}
+			cursor = max(cursor, end)
+		}
+
+		if cursor < source.end {
+			result.Changed = appendPageRange(result.Changed, cursor, source.end)
+		}
+	}
+
+	for _, fragment := range oldBlob.Fragments {
+		start, end := fragment.Offset, fragment.Offset+fragment.Size()
+
+		// Subtract the new page ranges from the old one; whatever remains was cleared
+		for _, newFragment := range newBlob.Fragments {
+			newStart, newEnd := newFragment.Offset, newFragment.Offset+newFragment.Size()
+			if newEnd <= start || newStart >= end {
+				continue
+			}
+
+			if newStart > start {
+				result.Cleared = append(result.Cleared, PageRange{start, newStart - start})
+			}
+			start = min(max(start, newEnd), end)
+		}
+
+		if start < end {
+			result.Cleared = append(result.Cleared, PageRange{start, end - start})
+		}
+	}
+
+	return result
+}
+
+// pageSource is a range of a page blob and the place in a chunk its data comes from
+type pageSource struct {
+	start, end  uint64
+	id          string
+	chunkOffset uint64
+}
+
+// pageSources maps the ranges covered by the fragments to their chunks, in order
+func pageSources(fragments []*PageBlobFragment) []pageSource {
+	result := make([]pageSource, 0)
+
+	for _, fragment := range fragments {
+		position, skip, left := fragment.Offset, fragment.Skip, fragment.Size()
+
+		for _, chunk := range fragment.Content {
+			if left == 0 {
+				break
+			}
+			if skip >= chunk.Size {
+				skip -= chunk.Size
+				continue
+			}
+
+			size := min(chunk.Size-skip, left)
+			result = append(result, pageSource{position, position + size, chunk.ID, skip})
+			position += size
+			left -= size
+			skip = 0
+		}
+	}
+
+	slices.SortFunc(result, func(a, b pageSource) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	return result
+}
+
+// appendPageRange adds [start, end) to the ranges, merging it with the last one if they're adjacent
+func appendPageRange(ranges []PageRange, start uint64, end uint64) []PageRange {
+	if len(ranges) > 0 {
+		last := &ranges[len(ranges)-1]
+		if last.Offset+last.Size == start {
+			last.Size += end - start
+			return ranges
+		}
+	}
+
+	return append(ranges, PageRange{start, end - start})
+}
@@ -1,84 +1,158 @@
 package backup
 
 import (
+	"bytes"
 	"encoding/hex"
-	"fmt"
+	"encoding/json"
 	"io"
+	"iter"
 	"os"
-	"path/filepath"
+	"slices"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/chunker"
 )
 
 type FileBuf struct {
-	ID   string
+	ID string
+	// Size is the logical (uncompressed) size of the data
 	Size uint64 // TODO: Perhaps implicit?
+	// Compression is the algorithm the data is stored with. Empty for FileBufs predating compression
+	Compression Compression `json:",omitempty"`
+	// StoredSize is the size of the data on disk, after compression and encryption.
+	// Zero for FileBufs predating compression
+	StoredSize uint64 `json:",omitempty"`
 }
 
-func NewFileBuf(contentMD5 []byte, size uint64) *FileBuf {
+// NewFileBuf constructs a FileBuf addressed by the given content hash.
+// For unencrypted repositories, that's the MD5 of the data; otherwise, a keyed hash.
+func NewFileBuf(contentHash []byte, size uint64) *FileBuf {
 	return &FileBuf{
-		ID:   hex.EncodeToString(contentMD5),
+		ID:   hex.EncodeToString(contentHash),
 		Size: size,
 	}
 }
 
-func (f *FileBuf) Path(base string) string {
-	// TODO: Do I need this separation by the first byte?
-	return filepath.Join(base, "files", f.ID[:2], f.ID)
+// IsRaw reports whether the data is stored uncompressed
+func (f *FileBuf) IsRaw() bool {
+	return f.Compression == "" || f.Compression == CompressionNone
+}
+
+// StoredSizeOrSize is the size on disk, falling back to the logical size if it isn't known
+func (f *FileBuf) StoredSizeOrSize() uint64 {
+	if f.StoredSize == 0 {
+		return f.Size
+	}
+
+	return f.StoredSize
+}
+
+// LazyReader reads the (decrypted) FileBuf contents, only opening it on the first read
+func (f *FileBuf) LazyReader(repo *Repository) io.ReadCloser {
+	return &lazyReader{
+		Open: func() (io.ReadCloser, error) {
+			return repo.openChunk(f)
+		},
+	}
+}
+
+// ChunkList is a sequence of FileBufs that together make up a contiguous piece of blob data
+type ChunkList []*FileBuf
+
+// MaxStoredSize bounds the size of the FileBufs stored with the given chunking parameters.
+// Compression never makes them larger, and encryption only adds a header and a tag
+func MaxStoredSize(params chunker.Params) int64 {
+	size := int64(chunker.NoneChunkSize)
+	if params.Algorithm != chunker.AlgorithmNone {
+		size = int64(params.MaxSize)
+	}
+
+	// AES-GCM: 16-byte tag of the content
+	return size + int64(len(chunkMagic)+sealedSize(masterKeySize)+16)
 }
 
-func (f *FileBuf) MD5() []byte {
-	result, err := hex.DecodeString(f.ID)
-	if err != nil {
-		panic(fmt.Sprintf("invalid FileBuf ID: %q", f.ID))
+var _ json.Unmarshaler = (*ChunkList)(nil)
+
+// Size is the total size of all the chunks
+func (l ChunkList) Size() uint64 {
+	result := uint64(0)
+	for _, chunk := range l {
+		result += chunk.Size
 	}
 
 	return result
 }
 
-func (f *FileBuf) LazyReader(base string) io.ReadCloser {
-	return &lazyFileReader{Path: f.Path(base), File: nil}
+// All iterates over the chunks
+func (l ChunkList) All() iter.Seq[*FileBuf] {
+	return slices.Values(l)
+}
+
+func (l ChunkList) LazyReader(repo *Repository) io.ReadCloser {
+	readers := make([]io.ReadCloser, 0, len(l))
+	for _, chunk := range l {
+		readers = append(readers, chunk.LazyReader(repo))
+	}
+
+	return ChainReader(readers...)
+}
+
+func (l *ChunkList) UnmarshalJSON(data []byte) error {
+	// Snapshots made before chunking was introduced store a single FileBuf here
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var single FileBuf
+		err := json.Unmarshal(trimmed, &single)
+		if err != nil {
+			return err
+		}
+
+		*l = ChunkList{&single}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]*FileBuf)(l))
 }
 
-type lazyFileReader struct {
-	Path string
-	File *os.File
-	Done bool
+type lazyReader struct {
+	Open   func() (io.ReadCloser, error)
+	Reader io.ReadCloser
+	Done   bool
 }
 
-func (r *lazyFileReader) Read(p []byte) (int, error) {
+func (r *lazyReader) Read(p []byte) (int, error) {
 	if r.Done {
 		return 0, io.EOF
 	}
 
-	if r.File == nil {
-		f, err := os.Open(r.Path)
+	if r.Reader == nil {
+		reader, err := r.Open()
 		if err != nil {
 			return 0, err
 		}
-		r.File = f
+		r.Reader = reader
 	}
 
-	n, err := r.File.Read(p)
+	n, err := r.Reader.Read(p)
 
 	if err == io.EOF {
-		r.File.Close()
-		r.File = nil
+		r.Reader.Close()
+		r.Reader = nil
 		r.Done = true
 	}
 
 	return n, err
 }
 
-func (r *lazyFileReader) Close() error {
-	if r.File == nil {
+func (r *lazyReader) Close() error {
+	if r.Reader == nil {
 		return os.ErrClosed
 	}
 
 	defer func() {
-		r.File = nil
+		r.Reader = nil
 		r.Done = true
 	}()
 
-	return r.File.Close()
+	return r.Reader.Close()
 }
 
 type multiReadCloser struct {
@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+type GCOptions struct {
+	// DryRun only reports what would be removed
+	DryRun bool
+	// Quarantine moves unreferenced FileBufs into quarantine instead of deleting them
+	Quarantine bool
+}
+
+type GCReport struct {
+	// Referenced is the number of FileBufs reachable from the snapshots
+	Referenced int
+	// Unreferenced is the number of stored FileBufs no snapshot refers to
+	Unreferenced int
+	// ReclaimableBytes is the on-disk size of the unreferenced FileBufs
+	ReclaimableBytes uint64
+}
+
+// CollectGarbage removes the FileBufs that aren't referenced by any snapshot.
+// The repository must be locked (see AcquireLock), so that FileBufs written
+// by a backup in progress aren't mistaken for garbage.
+func (r *Repository) CollectGarbage(ctx context.Context, options GCOptions) (*GCReport, error) {
+	if !r.holdsExclusiveLock() {
+		return nil, fmt.Errorf("garbage collection requires an exclusive repository lock")
+	}
+
+	if len(r.brokenSnapshots) > 0 {
+		// Their FileBufs would be considered garbage otherwise
+		return nil, fmt.Errorf("%v snapshot(s) failed to load, refusing to collect garbage", len(r.brokenSnapshots))
+	}
+
+	referenced := r.referencedFileBufs()
+
+	// An interrupted backup still refers to the data it has downloaded so far
+	pending, err := readJournal(r.Backend)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if pending != nil {
+		for fb := range pending.fileBufs() {
+			referenced[fb.ID] = struct{}{}
+		}
+	}
+
+	report := &GCReport{
+		Referenced: len(referenced),
+	}
+
+	// Modifying the listing while it's in progress isn't safe on every backend
+	var garbage []string
+	for object, err := range r.Backend.List(backend.KindData) {
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := referenced[object.Name]; ok {
+			continue
+		}
+
+		report.Unreferenced++
+		report.ReclaimableBytes += uint64(object.Size)
+		garbage = append(garbage, object.Name)
+	}
+
+	if options.DryRun {
+		return report, nil
+	}
+
+	if len(garbage) > 0 {
+		err = r.checkDeletable(backend.KindData)
+		if err != nil {
+			return nil, err
+		}
+
+		if options.Quarantine && r.archived(backend.KindData) {
+			return nil, fmt.Errorf("%w: quarantining FileBufs reads them, delete them without quarantine instead", fail.ErrArchived)
+		}
+	}
+
+	ctx, cancel := r.lockContext(ctx)
+	defer cancel()
+
+	for _, id := range garbage {
+		// Stops once the lock is lost, as whoever takes it over may reference the garbage again
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+
+		if options.Quarantine {
+			err = r.quarantine(id)
+		} else {
+			err = r.Backend.Delete(backend.KindData, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !options.DryRun {
+		log.Printf("Removed %v unreferenced FileBuf(s), %v bytes", report.Unreferenced, report.ReclaimableBytes)
+	}
+
+	return report, nil
+}
+
+// checkDeletable fails if the backend protects the objects of a kind from deletion,
+// so that an operation is refused up front rather than halfway through
+func (r *Repository) checkDeletable(kind backend.Kind) error {
+	if protector, ok := r.Backend.(backend.Protector); ok && protector.Protects(kind) {
+		return fmt.Errorf("%w: %v objects can't be deleted from %v", fail.ErrProtected, kind, r.Backend.Location())
+	}
+
+	return nil
+}
+
+// archived reports whether the objects of a kind have to be rehydrated before they can be read
+func (r *Repository) archived(kind backend.Kind) bool {
+	archiver, ok := r.Backend.(backend.Archiver)
+	return ok && archiver.Archives(kind)
+}
+
+// quarantine moves a FileBuf out of the way, so that it may still be restored by hand if the collection was a mistake
+func (r *Repository) quarantine(id string) error {
+	data, err := backend.ReadAll(r.Backend, backend.KindData, id)
+	if err != nil {
+		return err
+	}
+
+	err = r.Backend.Put(backend.KindQuarantine, id, data)
+	if err != nil {
+		return err
+	}
+
+	return r.Backend.Delete(backend.KindData, id)
+}
+
+// referencedFileBufs collects the IDs of all FileBufs reachable from any snapshot
+func (r *Repository) referencedFileBufs() map[string]struct{} {
+	result := make(map[string]struct{})
+
+	for _, snapshot := range r.Revisions {
+		for _, blob := range snapshot.Blobs {
+			for fb := range blob.FileBufs() {
+				result[fb.ID] = struct{}{}
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,44 @@
+package backup
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+
+	"lukechampine.com/blake3"
+)
+
+// ContentHash identifies the hash function used as the content address of FileBufs in unencrypted repositories
+type ContentHash string
+
+const (
+	// ContentHashMD5 is only kept for the repositories created before the choice was introduced
+	ContentHashMD5    ContentHash = "md5"
+	ContentHashSHA256 ContentHash = "sha256"
+	ContentHashBLAKE3 ContentHash = "blake3"
+)
+
+func (h ContentHash) Validate() error {
+	switch h {
+	case ContentHashMD5, ContentHashSHA256, ContentHashBLAKE3:
+		return nil
+	}
+
+	return fmt.Errorf("unknown content hash: %q", h)
+}
+
+func (h ContentHash) sum(data []byte) []byte {
+	switch h {
+	case ContentHashMD5:
+		result := md5.Sum(data)
+		return result[:]
+	case ContentHashSHA256:
+		result := sha256.Sum256(data)
+		return result[:]
+	case ContentHashBLAKE3:
+		result := blake3.Sum256(data)
+		return result[:]
+	default:
+		panic(fmt.Sprintf("unknown content hash: %q", h))
+	}
+}
@@ -0,0 +1,345 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/azure"
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+const (
+	// journalSegmentSize is the amount of buffered entries that triggers a flush
+	journalSegmentSize = 1024 * 1024
+	// journalFlushInterval is the longest the entries stay buffered, provided new ones keep coming
+	journalFlushInterval = 10 * time.Second
+)
+
+// journal records the progress of a backup as it goes, so that it may be resumed after an interruption.
+// Since backends can't append to objects, the entries are buffered and flushed as numbered segments.
+// A crash may only lose the entries buffered since the last flush
+type journal struct {
+	storage backend.Backend
+	start   journalStart
+	// ranges and blobs hold the completed work, indexed for lookups
+	ranges map[journalRangeKey]*journalRange
+	blobs  map[journalBlobKey]Blob
+
+	mu sync.Mutex
+	// segments are the names of the flushed segments
+	segments  []string
+	buf       []byte
+	lastFlush time.Time
+}
+
+type journalEntry struct {
+	Start *journalStart `json:"start,omitempty"`
+	Range *journalRange `json:"range,omitempty"`
+	Blob  *journalBlob  `json:"blob,omitempty"`
+}
+
+// journalStart describes the backup being performed. Always the first entry, and repeated on every resume
+type journalStart struct {
+	TakenAt     time.Time          `json:"taken_at"`
+	Tags        []string           `json:"tags,omitempty"`
+	Consistency *ConsistencyReport `json:"consistency,omitempty"`
+	Blobs       []azure.BlobInfo   `json:"blobs"`
+	// Skipped lists the blobs deleted before their snapshots were taken, either initially or when resuming
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// journalRange is a downloaded blob range. Source is the URL of the blob snapshot it comes from
+type journalRange struct {
+	Source     string    `json:"source"`
+	Offset     uint64    `json:"offset"`
+	Size       uint64    `json:"size"`
+	Content    ChunkList `json:"content"`
+	ContentMD5 []byte    `json:"content_md5"`
+}
+
+type journalRangeKey struct {
+	source string
+	offset uint64
+	size   uint64
+}
+
+// journalBlob is a blob that has been backed up completely
+type journalBlob struct {
+	Snapshot string `json:"snapshot"`
+	// Blob always holds exactly one blob, this is just to reuse the annotated encoding
+	Blob BlobList `json:"blob"`
+}
+
+type journalBlobKey struct {
+	name     string
+	snapshot string
+}
+
+// hasJournal reports whether an interrupted backup left its journal behind
+func hasJournal(storage backend.Backend) (bool, error) {
+	for _, err := range storage.List(backend.KindJournal) {
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// createJournal starts a new journal. Fails if one exists already
+func createJournal(storage backend.Backend, start journalStart) (*journal, error) {
+	pending, err := hasJournal(storage)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		return nil, fail.ErrInterruptedBackup
+	}
+
+	result := &journal{
+		storage: storage,
+		start:   start,
+		ranges:  make(map[journalRangeKey]*journalRange),
+		blobs:   make(map[journalBlobKey]Blob),
+	}
+
+	err = result.append(journalEntry{Start: &start})
+	if err != nil {
+		return nil, err
+	}
+
+	// The online snapshots must be known before anything else happens
+	err = result.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// readJournal loads an existing journal. Fails with fs.ErrNotExist if there is none
+func readJournal(storage backend.Backend) (*journal, error) {
+	result := &journal{
+		storage: storage,
+		ranges:  make(map[journalRangeKey]*journalRange),
+		blobs:   make(map[journalBlobKey]Blob),
+	}
+
+	for segment, err := range storage.List(backend.KindJournal) {
+		if err != nil {
+			return nil, err
+		}
+		result.segments = append(result.segments, segment.Name)
+	}
+	if len(result.segments) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	slices.Sort(result.segments)
+
+	header := false
+	for _, segment := range result.segments {
+		data, err := backend.ReadAll(storage, backend.KindJournal, segment)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+			var entry journalEntry
+			err = json.Unmarshal(line, &entry)
+			if err != nil {
+				return nil, fmt.Errorf("corrupt journal entry %v:%v: %w", segment, i+1, err)
+			}
+
+			switch {
+			case !header && entry.Start == nil:
+				return nil, fmt.Errorf("journal lacks a header")
+			case entry.Start != nil:
+				result.start = *entry.Start
+				header = true
+			case entry.Range != nil:
+				result.ranges[entry.Range.key()] = entry.Range
+			case entry.Blob != nil && len(entry.Blob.Blob) == 1:
+				blob := entry.Blob.Blob[0]
+				result.blobs[journalBlobKey{blob.Common().Name, entry.Blob.Snapshot}] = blob
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (r *journalRange) key() journalRangeKey {
+	return journalRangeKey{r.Source, r.Offset, r.Size}
+}
+
+func (j *journal) append(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.buf = append(j.buf, line...)
+	j.buf = append(j.buf, '\n')
+
+	if len(j.buf) < journalSegmentSize && time.Since(j.lastFlush) < journalFlushInterval {
+		return nil
+	}
+
+	return j.flushLocked()
+}
+
+// flush writes out the buffered entries as a new segment
+func (j *journal) flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.flushLocked()
+}
+
+func (j *journal) flushLocked() error {
+	if len(j.buf) == 0 {
+		return nil
+	}
+
+	// Segments are never removed one by one, so the count gives the next number even after a resume
+	name := fmt.Sprintf("%08d.jsonl", len(j.segments))
+	err := j.storage.Put(backend.KindJournal, name, j.buf)
+	if err != nil {
+		return err
+	}
+
+	j.segments = append(j.segments, name)
+	j.buf = j.buf[:0]
+	j.lastFlush = time.Now()
+	return nil
+}
+
+// recordRange remembers a downloaded range
+func (j *journal) recordRange(source string, offset uint64, size uint64, content ChunkList, contentMD5 []byte) error {
+	return j.append(journalEntry{Range: &journalRange{
+		Source:     source,
+		Offset:     offset,
+		Size:       size,
+		Content:    content,
+		ContentMD5: contentMD5,
+	}})
+}
+
+// recordBlob remembers a completely backed up blob
+func (j *journal) recordBlob(blobInfo azure.BlobInfo, blob Blob) error {
+	return j.append(journalEntry{Blob: &journalBlob{
+		Snapshot: blobInfo.Snapshot,
+		Blob:     BlobList{blob},
+	}})
+}
+
+// lookupRange finds a range downloaded earlier, provided its data is still intact on disk
+func (j *journal) lookupRange(repo *Repository, source string, offset uint64, size uint64) *journalRange {
+	found, ok := j.ranges[journalRangeKey{source, offset, size}]
+	if !ok || !repo.hasFileBufs(found.Content.All()) {
+		return nil
+	}
+
+	return found
+}
+
+// lookupBlob finds a blob backed up earlier from the same blob snapshot
+func (j *journal) lookupBlob(repo *Repository, blobInfo azure.BlobInfo) Blob {
+	found, ok := j.blobs[journalBlobKey{blobInfo.Name, blobInfo.Snapshot}]
+	if !ok || !repo.hasFileBufs(found.FileBufs()) {
+		return nil
+	}
+
+	return found
+}
+
+// fileBufs lists all FileBufs the journal refers to
+func (j *journal) fileBufs() iter.Seq[*FileBuf] {
+	return func(yield func(*FileBuf) bool) {
+		for _, found := range j.ranges {
+			for fb := range found.Content.All() {
+				if !yield(fb) {
+					return
+				}
+			}
+		}
+
+		for _, found := range j.blobs {
+			for fb := range found.FileBufs() {
+				if !yield(fb) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// close flushes the remaining entries
+func (j *journal) close() error {
+	return j.flush()
+}
+
+// remove deletes the journal, along with any entries not flushed yet
+func (j *journal) remove() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.buf = nil
+
+	var errs []error
+	for _, segment := range j.segments {
+		err := j.storage.Delete(backend.KindJournal, segment)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	j.segments = nil
+
+	return errors.Join(errs...)
+}
+
+// hasFileBufs checks that the FileBufs are all stored and have the expected size.
+// A size mismatch means the process was killed while writing the object
+func (r *Repository) hasFileBufs(fileBufs iter.Seq[*FileBuf]) bool {
+	for fb := range fileBufs {
+		info, err := r.Backend.Stat(backend.KindData, fb.ID)
+		if err != nil || uint64(info.Size) != fb.StoredSizeOrSize() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AbortBackup discards an interrupted backup, deleting the online snapshots it has taken, up to parallel at a time
+func (r *Repository) AbortBackup(ctx context.Context, parallel int) error {
+	pending, err := readJournal(r.Backend)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fail.ErrNoInterruptedBackup
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := azure.OpenClient(r.ContainerURL)
+	if err != nil {
+		return err
+	}
+
+	azure.DeleteSnapshots(ctx, client, pending.start.Blobs, parallel)
+
+	return pending.remove()
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"time"
+
+	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/gobwas/glob"
+)
+
+// SnapshotSummary describes a snapshot for listings
+type SnapshotSummary struct {
+	ID      string    `json:"id"`
+	SavedAt time.Time `json:"saved_at"`
+	Tags    []string  `json:"tags,omitempty"`
+	// Skew is the spread of the online snapshots the backup was made from
+	Skew time.Duration `json:"skew,omitempty"`
+	// Partial is set if some blobs failed to back up
+	Partial bool `json:"partial,omitempty"`
+	// Blobs is the number of (matching) blobs
+	Blobs int `json:"blobs"`
+	// LogicalSize is the total content size of the (matching) blobs
+	LogicalSize uint64 `json:"logical_size"`
+	// NewDataSize is the logical size of the FileBufs no earlier snapshot refers to
+	NewDataSize uint64 `json:"new_data_size"`
+}
+
+// Summarize lists all snapshots in chronological order, only accounting for the blobs matching targets
+func (r *Repository) Summarize(targets glob.Glob) []SnapshotSummary {
+	result := make([]SnapshotSummary, 0, len(r.Revisions))
+	// Note: blobs that don't match still count towards what's already stored
+	seen := make(map[string]struct{})
+
+	for _, snapshot := range r.Revisions {
+		summary := SnapshotSummary{
+			ID:      snapshot.ID,
+			SavedAt: snapshot.SavedAt,
+			Tags:    snapshot.Tags,
+			Skew:    snapshot.Skew,
+			Partial: snapshot.Partial,
+		}
+
+		for _, blob := range snapshot.Blobs {
+			matches := targets.Match(blob.Common().Name)
+			if matches {
+				summary.Blobs++
+				summary.LogicalSize += blob.Common().ContentSize
+			}
+
+			for fb := range blob.FileBufs() {
+				if _, ok := seen[fb.ID]; ok {
+					continue
+				}
+				seen[fb.ID] = struct{}{}
+
+				if matches {
+					summary.NewDataSize += fb.Size
+				}
+			}
+		}
+
+		result = append(result, summary)
+	}
+
+	return result
+}
+
+// BlobSummary describes a blob for listings
+type BlobSummary struct {
+	Name         string               `json:"name"`
+	Type         azcontainer.BlobType `json:"type"`
+	Size         uint64               `json:"size"`
+	ContentMD5   []byte               `json:"content_md5"`
+	LastModified time.Time            `json:"last_modified"`
+	Metadata     map[string]*string   `json:"metadata,omitempty"`
+}
+
+// ListBlobs describes the blobs matching targets
+func (s *Snapshot) ListBlobs(targets glob.Glob) []BlobSummary {
+	result := make([]BlobSummary, 0)
+
+	for _, blob := range s.Blobs {
+		common := blob.Common()
+		if !targets.Match(common.Name) {
+			continue
+		}
+
+		result = append(result, BlobSummary{
+			Name:         common.Name,
+			Type:         blob.Type(),
+			Size:         common.ContentSize,
+			ContentMD5:   common.ContentMD5,
+			LastModified: common.Timestamps.LastUpdated,
+			Metadata:     common.Metadata,
+		})
+	}
+
+	return result
+}
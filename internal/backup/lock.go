@@ -0,0 +1,376 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+// LockMode is the kind of lock a command holds on the repository
+type LockMode int
+
+const (
+	// LockNone doesn't lock the repository at all
+	LockNone LockMode = iota
+	// LockShared allows other readers, but no writers
+	LockShared
+	// LockExclusive allows nobody else
+	LockExclusive
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case LockShared:
+		return "shared"
+	case LockExclusive:
+		return "exclusive"
+	default:
+		return "none"
+	}
+}
+
+const (
+	// lockHeartbeatInterval is how often a held lock is refreshed
+	lockHeartbeatInterval = 30 * time.Second
+	// staleLockAge is how long a lock may go without a heartbeat before it's considered abandoned
+	staleLockAge = 5 * lockHeartbeatInterval
+	// lockRefreshAttempts is how many heartbeats in a row may fail before the lock is given up,
+	// which leaves some time to stop before others consider it stale
+	lockRefreshAttempts = 3
+)
+
+// lockInfo is the content of a repository lock file
+type lockInfo struct {
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Exclusive bool      `json:"exclusive"`
+	CreatedAt time.Time `json:"created_at"`
+	Heartbeat time.Time `json:"heartbeat"`
+	// name is the lock object this was loaded from
+	name string
+	// storage is where the lock is kept
+	storage backend.Backend
+}
+
+// repoLock is a lock held by this process, kept alive by a heartbeat
+type repoLock struct {
+	info lockInfo
+	// ctx is cancelled once the lock is lost, with fail.ErrLockLost as the cause
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// isStale reports whether the holder of the lock is gone
+func (l *lockInfo) isStale(now time.Time) bool {
+	if now.Sub(l.Heartbeat) > staleLockAge {
+		return true
+	}
+
+	// Processes on other hosts can't be checked directly
+	hostname, _ := os.Hostname()
+	return l.Hostname == hostname && !processAlive(l.PID)
+}
+
+func (l *lockInfo) conflicts(mode LockMode) bool {
+	return mode == LockExclusive || l.Exclusive
+}
+
+func (l *lockInfo) String() string {
+	mode := LockShared
+	if l.Exclusive {
+		mode = LockExclusive
+	}
+
+	return fmt.Sprintf(
+		"%v lock held by %v (pid %v) since %v, last heartbeat at %v",
+		mode, l.Hostname, l.PID,
+		l.CreatedAt.Local().Format(time.DateTime),
+		l.Heartbeat.Local().Format(time.DateTime),
+	)
+}
+
+func (l *lockInfo) write() error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	// Readers must never see a half-written lock, which Put guarantees
+	return l.storage.Put(backend.KindLock, l.name, data)
+}
+
+func (l *lockInfo) remove() error {
+	return l.storage.Delete(backend.KindLock, l.name)
+}
+
+// listLocks loads all locks in the repository
+func listLocks(storage backend.Backend) ([]lockInfo, error) {
+	var result []lockInfo
+	for object, err := range storage.List(backend.KindLock) {
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(object.Name, ".json") {
+			continue
+		}
+
+		data, err := backend.ReadAll(storage, backend.KindLock, object.Name)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var info lockInfo
+		err = json.Unmarshal(data, &info)
+		if err != nil {
+			return nil, fmt.Errorf("malformed lock %q: %w", object.Name, err)
+		}
+		info.name = object.Name
+		info.storage = storage
+
+		result = append(result, info)
+	}
+
+	return result, nil
+}
+
+// checkLocks fails if any live lock other than own conflicts with mode. Stale locks are removed along the way
+func (r *Repository) checkLocks(mode LockMode, own string) error {
+	locks, err := listLocks(r.Backend)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, info := range locks {
+		if info.name == own {
+			continue
+		}
+
+		if info.isStale(now) {
+			fmt.Printf("!! Removing a stale %v\n", &info)
+			_ = info.remove()
+			continue
+		}
+
+		if info.conflicts(mode) {
+			return fmt.Errorf("%w: %v", fail.ErrRepositoryLocked, &info)
+		}
+	}
+
+	return nil
+}
+
+// AcquireLock locks the repository, preventing conflicting access by other processes.
+// A shared lock is enough to read the repository, while modifying it takes an exclusive one.
+// The lock is released by Close
+func (r *Repository) AcquireLock(mode LockMode) error {
+	if mode == LockNone {
+		return nil
+	}
+	if r.lock != nil {
+		if r.lock.info.Exclusive || mode == LockShared {
+			return nil
+		}
+		return fmt.Errorf("cannot upgrade a shared repository lock")
+	}
+
+	err := r.checkLocks(mode, "")
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	now := time.Now()
+	info := lockInfo{
+		Hostname:  hostname,
+		PID:       os.Getpid(),
+		Exclusive: mode == LockExclusive,
+		CreatedAt: now,
+		Heartbeat: now,
+		name:      fmt.Sprintf("%v-%v-%v.json", hostname, os.Getpid(), hex.EncodeToString(suffix)),
+		storage:   r.Backend,
+	}
+
+	err = info.write()
+	if err != nil {
+		return err
+	}
+
+	// Someone might have taken a conflicting lock in between. Then both back off, which is fine
+	err = r.checkLocks(mode, info.name)
+	if err != nil {
+		_ = info.remove()
+		return err
+	}
+
+	lockCtx, cancel := context.WithCancelCause(context.Background())
+	r.lock = &repoLock{
+		info:   info,
+		ctx:    lockCtx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go r.lock.heartbeat()
+
+	return nil
+}
+
+func (l *repoLock) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(lockHeartbeatInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := l.refresh()
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		fmt.Printf("!! Failed to refresh the repository lock: %v\n", err)
+		if !errors.Is(err, fail.ErrLockLost) && failures < lockRefreshAttempts {
+			continue
+		}
+
+		// Refreshing any further might resurrect a lock someone else has removed as stale
+		if !errors.Is(err, fail.ErrLockLost) {
+			err = fmt.Errorf("%w: %w", fail.ErrLockLost, err)
+		}
+		l.cancel(err)
+		<-l.stop
+		return
+	}
+}
+
+// refresh updates the heartbeat of the lock, unless it has been removed in the meantime
+func (l *repoLock) refresh() error {
+	_, err := l.info.storage.Stat(backend.KindLock, l.info.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: removed by another process", fail.ErrLockLost)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.info.Heartbeat = time.Now()
+	return l.info.write()
+}
+
+// lockContext derives a context that is cancelled once the repository lock is lost,
+// so that the operation relying on it stops instead of racing with the next lock holder
+func (r *Repository) lockContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.lock == nil {
+		return context.WithCancel(ctx)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(r.lock.ctx, func() {
+		cancel(context.Cause(r.lock.ctx))
+	})
+
+	return ctx, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
+// lockError reports the loss of the lock instead of the errors caused by the cancellation
+func lockError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(context.Cause(ctx), fail.ErrLockLost) {
+		return context.Cause(ctx)
+	}
+
+	return err
+}
+
+// holdsExclusiveLock reports whether this process may modify the repository
+func (r *Repository) holdsExclusiveLock() bool {
+	return r.lock != nil && r.lock.info.Exclusive
+}
+
+// verifyLock fails if the held lock was given up or removed by someone who took it for stale
+func (r *Repository) verifyLock() error {
+	if err := context.Cause(r.lock.ctx); err != nil {
+		return err
+	}
+
+	_, err := r.Backend.Stat(backend.KindLock, r.lock.info.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: removed by another process", fail.ErrLockLost)
+	}
+	return err
+}
+
+func (r *Repository) releaseLock() error {
+	if r.lock == nil {
+		return nil
+	}
+
+	close(r.lock.stop)
+	<-r.lock.done
+	r.lock.cancel(context.Canceled)
+
+	err := r.lock.info.remove()
+	r.lock = nil
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed by someone who took it for stale, which has been reported already
+		return nil
+	}
+	return err
+}
+
+// RemoveLocks removes the stale locks, or all of them. Returns the number of locks removed
+func RemoveLocks(storage backend.Backend, all bool) (int, error) {
+	locks, err := listLocks(storage)
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	removed := 0
+	now := time.Now()
+	for _, info := range locks {
+		if !all && !info.isStale(now) {
+			continue
+		}
+
+		err = info.remove()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+
+		removed++
+	}
+
+	return removed, errors.Join(errs...)
+}
@@ -1,31 +1,131 @@
 package backup
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"io"
+	"iter"
+	"log"
+	"slices"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
 )
 
 type PageBlob struct {
 	CommonBlob
-	// Fragments is the list of this blob's pages
+	// ServerSnapshot is the online snapshot this backup was made from.
+	// It is retained on the server, so that the next backup only has to fetch the changed pages.
+	// While it is, the source blob can only be deleted together with its snapshots (DeleteSnapshots=include)
+	ServerSnapshot string `json:",omitempty"`
+	// Fragments is the list of this blob's pages, sorted by offset
 	Fragments []*PageBlobFragment
 }
 
-// TODO: Support clearing parts in the middle of a page range?
-// We don't always want to keep the entire history, though.
-// For that scenario, I'll need
+// PageBlobFragment is a contiguous range of pages. Once some of its pages
+// are updated or cleared, only the remaining parts of Content are referenced.
 type PageBlobFragment struct {
 	// Offset is the fragment offset (512-bytes-aligned)
 	Offset uint64
-	// Content is the fragment data (512-bytes-aligned in size)
-	Content *FileBuf
-	// ContentMD5 is the MD5 hash of the fragment
+	// Content is the fragment data (512-bytes-aligned in size), split into chunks
+	Content ChunkList
+	// Skip is the number of bytes at the start of Content that aren't part of the fragment
+	Skip uint64 `json:",omitempty"`
+	// Length is the number of bytes of Content (after Skip) that are part of the fragment.
+	// Zero means all of it
+	Length uint64 `json:",omitempty"`
+	// ContentMD5 is the MD5 hash of the downloaded range.
+	// Nil if the fragment only references a part of it
 	ContentMD5 []byte
 }
 
+// Size is the number of bytes the fragment covers
+func (f *PageBlobFragment) Size() uint64 {
+	if f.Length != 0 {
+		return f.Length
+	}
+
+	return f.Content.Size() - f.Skip
+}
+
+func (f *PageBlobFragment) LazyReader(repo *Repository) io.ReadCloser {
+	reader := f.Content.LazyReader(repo)
+	if f.Skip == 0 && f.Length == 0 {
+		return reader
+	}
+
+	return &sectionReader{
+		ReadCloser: reader,
+		skip:       f.Skip,
+		left:       f.Size(),
+	}
+}
+
+// slice cuts out the part of the fragment covering [start, end) of the blob.
+// Chunks not overlapping with it are dropped, so they may be garbage collected later.
+func (f *PageBlobFragment) slice(start uint64, end uint64) *PageBlobFragment {
+	contentStart := f.Skip + start - f.Offset
+	contentEnd := contentStart + end - start
+
+	result := &PageBlobFragment{
+		Offset:  start,
+		Content: make(ChunkList, 0, len(f.Content)),
+		Length:  end - start,
+	}
+
+	chunkStart := uint64(0)
+	for _, chunk := range f.Content {
+		chunkEnd := chunkStart + chunk.Size
+
+		if chunkEnd <= contentStart {
+			chunkStart = chunkEnd
+			continue
+		}
+		if chunkStart >= contentEnd {
+			break
+		}
+
+		if len(result.Content) == 0 {
+			result.Skip = contentStart - chunkStart
+		}
+		result.Content = append(result.Content, chunk)
+		chunkStart = chunkEnd
+	}
+
+	return result
+}
+
+// punchPages removes the given ranges from the fragments
+func punchPages(fragments []*PageBlobFragment, ranges []pageInfo) []*PageBlobFragment {
+	for _, punched := range ranges {
+		punchStart, punchEnd := punched.Offset, punched.Offset+punched.Size
+		result := make([]*PageBlobFragment, 0, len(fragments))
+
+		for _, fragment := range fragments {
+			start, end := fragment.Offset, fragment.Offset+fragment.Size()
+
+			if punchEnd <= start || punchStart >= end {
+				result = append(result, fragment)
+				continue
+			}
+
+			if start < punchStart {
+				result = append(result, fragment.slice(start, punchStart))
+			}
+			if punchEnd < end {
+				result = append(result, fragment.slice(punchEnd, end))
+			}
+		}
+
+		fragments = result
+	}
+
+	return fragments
+}
+
 func DownloadPageBlob(
 	ctx context.Context,
 	repo *Repository,
@@ -39,46 +139,85 @@ func DownloadPageBlob(
 		return nil, err
 	}
 
-	pages, err := listPages(ctx, client)
+	commonBlob, _, err := downloadCommon(ctx, client.BlobClient(), name)
 	if err != nil {
 		return nil, err
 	}
 
-	commonBlob, err := downloadCommon(ctx, client.BlobClient(), name)
+	blob := &PageBlob{
+		CommonBlob:     *commonBlob,
+		ServerSnapshot: snapshot,
+	}
+
+	// Unlike blob blocks, here we may reuse the data from previous versions of the blob,
+	// as long as we know which pages were changed since then
+	if prev != nil && prev.ServerSnapshot != "" {
+		changed, cleared, err := listPagesDiff(ctx, client, prev.ServerSnapshot)
+		if err == nil {
+			// Pages past the end of a shrunk blob are gone as well
+			if prev.ContentSize > blob.ContentSize {
+				cleared = append(cleared, pageInfo{
+					Offset: blob.ContentSize,
+					Size:   prev.ContentSize - blob.ContentSize,
+				})
+			}
+
+			blob.Fragments = punchPages(prev.Fragments, append(changed, cleared...))
+
+			err = blob.downloadPages(ctx, repo, client, changed)
+			if err != nil {
+				return nil, err
+			}
+
+			return blob, nil
+		}
+
+		log.Printf("Warning: Failed to diff pages of %q against the retained snapshot, downloading it fully: %v", name, err)
+	}
+
+	pages, err := listPages(ctx, client)
 	if err != nil {
 		return nil, err
 	}
 
-	blob := &PageBlob{
-		CommonBlob: *commonBlob,
-		Fragments:  make([]*PageBlobFragment, 0, len(pages)),
+	blob.Fragments = make([]*PageBlobFragment, 0, len(pages))
+
+	err = blob.downloadPages(ctx, repo, client, pages)
+	if err != nil {
+		return nil, err
 	}
 
-	/*knownFragments := make(map[uint64]*PageBlobFragment)
-	if prev != nil {
-		// TODO: unlike blob blocks, here we might be interested in fragments from previous
-		// versions of the blob. Also, perhaps look up based on MD5 instead of the offset?
-		for _, fragment := range prev.Fragments {
-			knownFragments[fragment.Offset] = fragment
-		}
-	}*/
+	return blob, nil
+}
+
+// downloadPages adds fragments for the given page ranges
+func (p *PageBlob) downloadPages(ctx context.Context, repo *Repository, client *pageblob.Client, pages []pageInfo) error {
+	fragments := make([]*PageBlobFragment, len(pages))
 
-	for _, page := range pages {
-		fb, err := repo.DownloadBlobRangeAsFileBuf(ctx, client.BlobClient(), page.Offset, page.Size)
+	err := repo.forEachRange(ctx, len(pages), func(ctx context.Context, i int) error {
+		chunks, contentMD5, err := repo.DownloadBlobRange(ctx, client.BlobClient(), pages[i].Offset, pages[i].Size)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		fragment := &PageBlobFragment{
-			Offset:     page.Offset,
-			Content:    fb,
-			ContentMD5: fb.MD5(),
+		fragments[i] = &PageBlobFragment{
+			Offset:     pages[i].Offset,
+			Content:    chunks,
+			ContentMD5: contentMD5,
 		}
-
-		blob.Fragments = append(blob.Fragments, fragment)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return blob, nil
+	p.Fragments = append(p.Fragments, fragments...)
+
+	slices.SortFunc(p.Fragments, func(a, b *PageBlobFragment) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+
+	return nil
 }
 
 type pageInfo struct {
@@ -86,6 +225,14 @@ type pageInfo struct {
 	Size   uint64
 }
 
+// Note: page range ends are inclusive
+func toPageInfo(start *int64, end *int64) pageInfo {
+	return pageInfo{
+		Offset: uint64(*start),
+		Size:   uint64(*end) - uint64(*start) + 1,
+	}
+}
+
 func listPages(ctx context.Context, client *pageblob.Client) ([]pageInfo, error) {
 	pagePager := client.NewGetPageRangesPager(nil)
 	result := make([]pageInfo, 0, 8)
@@ -97,16 +244,39 @@ func listPages(ctx context.Context, client *pageblob.Client) ([]pageInfo, error)
 		}
 
 		for _, page := range pagePage.PageRange {
-			result = append(result, pageInfo{
-				Offset: uint64(*page.Start),
-				Size:   uint64(*page.End) - uint64(*page.Start),
-			})
+			result = append(result, toPageInfo(page.Start, page.End))
 		}
 	}
 
 	return result, nil
 }
 
+// listPagesDiff lists the pages changed and cleared since an earlier snapshot of the blob
+func listPagesDiff(ctx context.Context, client *pageblob.Client, prevSnapshot string) ([]pageInfo, []pageInfo, error) {
+	pagePager := client.NewGetPageRangesDiffPager(&pageblob.GetPageRangesDiffOptions{
+		PrevSnapshot: &prevSnapshot,
+	})
+	changed := make([]pageInfo, 0, 8)
+	cleared := make([]pageInfo, 0, 8)
+
+	for pagePager.More() {
+		pagePage, err := pagePager.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, page := range pagePage.PageRange {
+			changed = append(changed, toPageInfo(page.Start, page.End))
+		}
+
+		for _, page := range pagePage.ClearRange {
+			cleared = append(cleared, toPageInfo(page.Start, page.End))
+		}
+	}
+
+	return changed, cleared, nil
+}
+
 func (*PageBlob) Type() azcontainer.BlobType {
 	return azcontainer.BlobTypePageBlob
 }
@@ -153,17 +323,107 @@ func (p *PageBlob) Export(ctx context.Context, repo *Repository) io.ReadCloser {
 			readers = append(readers, &padding{size: fragment.Offset - lastOffset})
 			lastOffset = fragment.Offset
 		}
-		readers = append(readers, fragment.Content.LazyReader(repo.LocalPath))
-		lastOffset += fragment.Content.Size
+		readers = append(readers, fragment.LazyReader(repo))
+		lastOffset += fragment.Size()
+	}
+
+	// Trailing pages may be unallocated too
+	if p.ContentSize > lastOffset {
+		readers = append(readers, &padding{size: p.ContentSize - lastOffset})
 	}
 
 	return ChainReader(readers...)
 }
 
+// sectionReader only passes through a part of the underlying stream
+type sectionReader struct {
+	io.ReadCloser
+	skip uint64
+	left uint64
+}
+
+func (s *sectionReader) Read(p []byte) (int, error) {
+	if s.skip > 0 {
+		_, err := io.CopyN(io.Discard, s.ReadCloser, int64(s.skip))
+		if err != nil {
+			return 0, err
+		}
+		s.skip = 0
+	}
+
+	if s.left == 0 {
+		return 0, io.EOF
+	}
+
+	n, err := s.ReadCloser.Read(p[:min(uint64(len(p)), s.left)])
+	s.left -= uint64(n)
+
+	return n, err
+}
+
+func (p *PageBlob) FileBufs() iter.Seq[*FileBuf] {
+	return func(yield func(*FileBuf) bool) {
+		for _, fragment := range p.Fragments {
+			for fb := range fragment.Content.All() {
+				if !yield(fb) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *PageBlob) Restore(ctx context.Context, repo *Repository, contClient *azcontainer.Client, conditions *azblob.AccessConditions) error {
+	client := contClient.NewPageBlobClient(p.Name)
+
+	_, err := client.Create(ctx, int64(p.ContentSize), &pageblob.CreateOptions{
+		HTTPHeaders:      p.restoreHeaders(),
+		Metadata:         p.Metadata,
+		AccessConditions: conditions,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, fragment := range p.Fragments {
+		reader := fragment.LazyReader(repo)
+
+		err = forEachPiece(reader, func(offset uint64, piece []byte) error {
+			// A fresh page blob is all zeroes, so uploading those would only waste space
+			if isZero(piece) {
+				return nil
+			}
+
+			_, err := client.UploadPages(ctx, streaming.NopCloser(bytes.NewReader(piece)), azblob.HTTPRange{
+				Offset: int64(fragment.Offset + offset),
+				Count:  int64(len(piece)),
+			}, nil)
+			return err
+		})
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (p *PageBlob) ShallowClone() Blob {
 	return &PageBlob{
-		CommonBlob: p.CommonBlob,
-		Fragments:  p.Fragments,
+		CommonBlob:     p.CommonBlob,
+		ServerSnapshot: p.ServerSnapshot,
+		Fragments:      p.Fragments,
 	}
 }
 
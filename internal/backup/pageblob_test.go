@@ -0,0 +1,200 @@
+package backup
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// chunks makes a ChunkList with chunks of the given sizes, named by their position
+func chunks(sizes ...uint64) ChunkList {
+	result := make(ChunkList, len(sizes))
+	for i, size := range sizes {
+		result[i] = &FileBuf{ID: fmt.Sprint(i), Size: size}
+	}
+	return result
+}
+
+// fragmentView is what matters about a fragment for comparison
+type fragmentView struct {
+	Offset uint64
+	Size   uint64
+	Skip   uint64
+	Chunks []string
+}
+
+func viewFragments(fragments []*PageBlobFragment) []fragmentView {
+	result := make([]fragmentView, len(fragments))
+	for i, fragment := range fragments {
+		result[i] = fragmentView{
+			Offset: fragment.Offset,
+			Size:   fragment.Size(),
+			Skip:   fragment.Skip,
+		}
+		for _, chunk := range fragment.Content {
+			result[i].Chunks = append(result[i].Chunks, chunk.ID)
+		}
+	}
+	return result
+}
+
+func TestSlice(t *testing.T) {
+	// Covers [1024, 4096) of the blob with chunks of 1024 bytes each
+	fragment := &PageBlobFragment{
+		Offset:  1024,
+		Content: chunks(1024, 1024, 1024),
+	}
+
+	tests := []struct {
+		name       string
+		start, end uint64
+		want       fragmentView
+	}{
+		{"whole", 1024, 4096, fragmentView{1024, 3072, 0, []string{"0", "1", "2"}}},
+		{"first chunk", 1024, 2048, fragmentView{1024, 1024, 0, []string{"0"}}},
+		{"last chunk", 3072, 4096, fragmentView{3072, 1024, 0, []string{"2"}}},
+		{"inside a chunk", 2560, 3072, fragmentView{2560, 512, 512, []string{"1"}}},
+		{"across chunks", 1536, 3584, fragmentView{1536, 2048, 512, []string{"0", "1", "2"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := viewFragments([]*PageBlobFragment{fragment.slice(test.start, test.end)})[0]
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("slice(%v, %v) = %+v, want %+v", test.start, test.end, got, test.want)
+			}
+		})
+	}
+
+	// Slicing an already sliced fragment has to account for its skip
+	sliced := fragment.slice(1536, 4096).slice(2560, 3584)
+	got := viewFragments([]*PageBlobFragment{sliced})[0]
+	want := fragmentView{2560, 1024, 512, []string{"1", "2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nested slice = %+v, want %+v", got, want)
+	}
+}
+
+func TestPunchPages(t *testing.T) {
+	fragments := []*PageBlobFragment{
+		{Offset: 0, Content: chunks(1024, 1024)},
+		{Offset: 4096, Content: chunks(512)},
+	}
+
+	tests := []struct {
+		name   string
+		ranges []pageInfo
+		want   []fragmentView
+	}{
+		{
+			"nothing",
+			nil,
+			[]fragmentView{{0, 2048, 0, []string{"0", "1"}}, {4096, 512, 0, []string{"0"}}},
+		},
+		{
+			"outside",
+			[]pageInfo{{Offset: 2048, Size: 2048}},
+			[]fragmentView{{0, 2048, 0, []string{"0", "1"}}, {4096, 512, 0, []string{"0"}}},
+		},
+		{
+			"whole fragment",
+			[]pageInfo{{Offset: 4096, Size: 512}},
+			[]fragmentView{{0, 2048, 0, []string{"0", "1"}}},
+		},
+		{
+			"head",
+			[]pageInfo{{Offset: 0, Size: 512}},
+			[]fragmentView{{512, 1536, 512, []string{"0", "1"}}, {4096, 512, 0, []string{"0"}}},
+		},
+		{
+			"tail",
+			[]pageInfo{{Offset: 1024, Size: 1024}},
+			[]fragmentView{{0, 1024, 0, []string{"0"}}, {4096, 512, 0, []string{"0"}}},
+		},
+		{
+			"middle",
+			[]pageInfo{{Offset: 512, Size: 1024}},
+			[]fragmentView{{0, 512, 0, []string{"0"}}, {1536, 512, 512, []string{"1"}}, {4096, 512, 0, []string{"0"}}},
+		},
+		{
+			"across fragments",
+			[]pageInfo{{Offset: 1536, Size: 3072}},
+			[]fragmentView{{0, 1536, 0, []string{"0", "1"}}},
+		},
+		{
+			"several",
+			[]pageInfo{{Offset: 0, Size: 512}, {Offset: 1536, Size: 512}},
+			[]fragmentView{{512, 1024, 512, []string{"0", "1"}}, {4096, 512, 0, []string{"0"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := viewFragments(punchPages(fragments, test.ranges))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("punchPages(%v) = %+v, want %+v", test.ranges, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiffPages(t *testing.T) {
+	old := []*PageBlobFragment{
+		{Offset: 0, Content: chunks(1024, 1024, 1024, 1024)},
+		{Offset: 8192, Content: chunks(1024)},
+	}
+
+	rewritten := &FileBuf{ID: "new", Size: 512}
+
+	tests := []struct {
+		name      string
+		fragments []*PageBlobFragment
+		changed   []PageRange
+		cleared   []PageRange
+	}{
+		{
+			"unchanged",
+			old,
+			[]PageRange{},
+			[]PageRange{},
+		},
+		{
+			// Only the written range differs, though the rest of the fragment is split around it
+			"punched",
+			slices.Insert(
+				punchPages(old, []pageInfo{{Offset: 1536, Size: 512}}),
+				1, &PageBlobFragment{Offset: 1536, Content: ChunkList{rewritten}},
+			),
+			[]PageRange{{1536, 512}},
+			[]PageRange{},
+		},
+		{
+			"same chunk elsewhere",
+			[]*PageBlobFragment{
+				{Offset: 0, Content: chunks(1024, 1024, 1024, 1024)},
+				{Offset: 9216, Content: chunks(1024)},
+			},
+			[]PageRange{{9216, 1024}},
+			[]PageRange{{8192, 1024}},
+		},
+		{
+			"cleared",
+			punchPages(old, []pageInfo{{Offset: 1024, Size: 1024}}),
+			[]PageRange{},
+			[]PageRange{{1024, 1024}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := diffPages(&PageBlob{Fragments: old}, &PageBlob{Fragments: test.fragments})
+			if !reflect.DeepEqual(got.Changed, test.changed) {
+				t.Errorf("changed = %v, want %v", got.Changed, test.changed)
+			}
+			if !reflect.DeepEqual(got.Cleared, test.cleared) {
+				t.Errorf("cleared = %v, want %v", got.Cleared, test.cleared)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/abel1502/mipt-kp-m-test/internal/azure"
+)
+
+// maxRangeRequestSize is the largest range Azure will compute a transactional MD5 for
+const maxRangeRequestSize = 4 * 1024 * 1024
+
+// maxPieceRetries is how many times a piece is requested again after its response breaks off
+const maxPieceRetries = 3
+
+// rangeReader streams a blob range through a series of requests small enough for Azure to checksum.
+// The checksums only guard the transfer, the content is addressed by a locally computed hash regardless
+type rangeReader struct {
+	ctx    context.Context
+	client *azblob.Client
+	offset uint64
+	end    uint64
+
+	// body is the response to the current request, if any
+	body      io.ReadCloser
+	pieceSize uint64
+	pieceRead uint64
+	pieceMD5  []byte
+	pieceHash hash.Hash
+	// pieceRetries is the number of times the current piece has been requested again
+	pieceRetries int
+}
+
+func newRangeReader(ctx context.Context, client *azblob.Client, offset uint64, size uint64) *rangeReader {
+	return &rangeReader{
+		ctx:       ctx,
+		client:    client,
+		offset:    offset,
+		end:       offset + size,
+		pieceHash: md5.New(),
+	}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.body == nil {
+		if r.offset == r.end {
+			return 0, io.EOF
+		}
+
+		err := r.request()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.body.Read(p)
+	r.pieceHash.Write(p[:n])
+	r.pieceRead += uint64(n)
+
+	if errors.Is(err, io.EOF) && r.pieceRead < r.pieceSize {
+		err = r.retry(io.ErrUnexpectedEOF)
+	} else if errors.Is(err, io.EOF) {
+		err = r.finishPiece()
+	} else if err != nil {
+		err = r.retry(err)
+	}
+
+	return n, err
+}
+
+// retry requests the current piece again after its response broke off, skipping the part returned already.
+// That part is compared with the new response, so that the transactional MD5 still covers everything returned
+func (r *rangeReader) retry(cause error) error {
+	delivered, deliveredMD5 := r.pieceRead, r.pieceHash.Sum(nil)
+
+	for {
+		if r.ctx.Err() != nil || r.pieceRetries >= maxPieceRetries {
+			return cause
+		}
+		r.pieceRetries++
+		fmt.Printf("!! Retrying the range at %v after %v bytes: %v\n", r.offset, delivered, cause)
+
+		_ = r.Close()
+		err := r.request()
+		if err != nil {
+			cause = err
+			continue
+		}
+
+		_, err = io.CopyN(r.pieceHash, r.body, int64(delivered))
+		if err != nil {
+			cause = err
+			continue
+		}
+
+		if !bytes.Equal(r.pieceHash.Sum(nil), deliveredMD5) {
+			return fmt.Errorf("range at %v was corrupted in transit: the retried response differs", r.offset)
+		}
+
+		r.pieceRead = delivered
+		return nil
+	}
+}
+
+func (r *rangeReader) request() error {
+	r.pieceSize = min(r.end-r.offset, maxRangeRequestSize)
+
+	stream, err := r.client.DownloadStream(r.ctx, &azblob.DownloadStreamOptions{
+		Range: azblob.HTTPRange{
+			Offset: int64(r.offset),
+			Count:  int64(r.pieceSize),
+		},
+		RangeGetContentMD5: azure.Addressof(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	if stream.ContentLength == nil || uint64(*stream.ContentLength) != r.pieceSize {
+		_ = stream.Body.Close()
+		return fmt.Errorf("unexpected response size for range at %v: want %v bytes", r.offset, r.pieceSize)
+	}
+
+	r.body = stream.Body
+	r.pieceRead = 0
+	r.pieceMD5 = stream.ContentMD5
+	r.pieceHash.Reset()
+	return nil
+}
+
+// finishPiece verifies the piece that has just been read completely
+func (r *rangeReader) finishPiece() error {
+	err := r.body.Close()
+	r.body = nil
+	if err != nil {
+		return err
+	}
+
+	if r.pieceRead != r.pieceSize {
+		return fmt.Errorf("range at %v was cut short: got %v bytes, want %v", r.offset, r.pieceRead, r.pieceSize)
+	}
+
+	// Note: the checksum is only missing if the server doesn't support it
+	if r.pieceMD5 != nil && !bytes.Equal(r.pieceHash.Sum(nil), r.pieceMD5) {
+		return fmt.Errorf("range at %v was corrupted in transit: MD5 mismatch", r.offset)
+	}
+
+	r.offset += r.pieceSize
+	r.pieceRetries = 0
+	return nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+)
+
+// flakyBlob serves ranges of a blob, failing the requests as told by the script.
+// Each entry is consumed by one request: "ok", "break" to cut the body off halfway, or "error" for a 500
+type flakyBlob struct {
+	data []byte
+
+	mu       sync.Mutex
+	script   []string
+	requests int
+}
+
+func (f *flakyBlob) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	action := "ok"
+	if len(f.script) > 0 {
+		action, f.script = f.script[0], f.script[1:]
+	}
+	f.requests++
+	f.mu.Unlock()
+
+	if action == "error" {
+		http.Error(w, "transient failure", http.StatusInternalServerError)
+		return
+	}
+
+	var start, end int
+	_, err := fmt.Sscanf(strings.TrimPrefix(r.Header.Get("x-ms-range"), "bytes="), "%d-%d", &start, &end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	piece := f.data[start : end+1]
+	hash := md5.Sum(piece)
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(piece)))
+	w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(hash[:]))
+	w.WriteHeader(http.StatusPartialContent)
+
+	if action != "break" {
+		_, _ = w.Write(piece)
+		return
+	}
+
+	_, _ = w.Write(piece[:len(piece)/2])
+	w.(http.Flusher).Flush()
+
+	// Dropping the connection leaves the response short of its Content-Length
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		_ = conn.Close()
+	}
+}
+
+func readRange(t *testing.T, blob *flakyBlob, offset uint64, size uint64) ([]byte, error) {
+	t.Helper()
+
+	server := httptest.NewServer(blob)
+	defer server.Close()
+
+	client, err := azblob.NewClientWithNoCredential(server.URL+"/container/blob", &azblob.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			// The SDK's own retries would hide the failures from the reader
+			Retry: policy.RetryOptions{MaxRetries: -1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newRangeReader(context.Background(), client, offset, size)
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func TestRangeReaderRetries(t *testing.T) {
+	data := randomBytes(2*maxRangeRequestSize + 1000)
+
+	tests := []struct {
+		name   string
+		script []string
+		ok     bool
+	}{
+		{"clean", nil, true},
+		{"broken off", []string{"break"}, true},
+		{"broken off twice", []string{"ok", "break", "break"}, true},
+		{"transient error on the retry", []string{"break", "error", "ok"}, true},
+		{"too many failures", []string{"break", "break", "error", "break"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blob := &flakyBlob{data: data, script: test.script}
+			got, err := readRange(t, blob, 100, uint64(len(data)-100))
+
+			if !test.ok {
+				if err == nil {
+					t.Errorf("read succeeded after %v requests", blob.requests)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("read failed after %v requests: %v", blob.requests, err)
+			}
+			if !bytes.Equal(got, data[100:]) {
+				t.Error("read data differs from the blob")
+			}
+		})
+	}
+}
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
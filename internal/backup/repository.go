@@ -1,47 +1,126 @@
 package backup
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
-	"os"
-	"path/filepath"
 	"slices"
+	"strings"
+	"time"
 
 	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/abel1502/mipt-kp-m-test/internal/azure"
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
+	"github.com/abel1502/mipt-kp-m-test/internal/chunker"
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+	"golang.org/x/sync/errgroup"
 )
 
 type Repository struct {
 	// ContainerURL is the URL of the container to back up
 	ContainerURL string `json:"container_url"`
-	// LocalPath is the path to the repository's root directory on the local filesystem.
-	// FileBufs are stored in the "files" subdirectory (binary files);
-	// Snapshots are stored in the "snapshots" subdirectory (json files);
-	// Repository-wide metadata is stored in an "info.json" file.
-	LocalPath string `json:"-"`
+	// Chunking configures how downloaded blob ranges are split into FileBufs.
+	// Repositories created before chunking was introduced don't have it set,
+	// which is equivalent to chunker.AlgorithmNone.
+	Chunking chunker.Params `json:"chunking"`
+	// Compression is the algorithm new FileBufs are compressed with, if they appear compressible.
+	// Repositories created before compression was introduced don't have it set,
+	// which is equivalent to CompressionNone.
+	Compression Compression `json:"compression"`
+	// ContentHash is the content address of FileBufs, unless the repository is encrypted
+	ContentHash ContentHash `json:"content_hash,omitempty"`
+	// Encryption is the key material for encrypting FileBufs. Nil for plaintext repositories
+	Encryption *EncryptionConfig `json:"encryption,omitempty"`
+	// Backend is where the repository is stored.
+	// FileBufs are stored as data objects (binary);
+	// Snapshots are stored as index objects (json);
+	// Repository-wide metadata is stored in the "info.json" config object.
+	Backend backend.Backend `json:"-"`
 	// Revisions are the container snapshots in the chronological order.
 	// Note that different revisions in a repository might share some
 	// of the blob content pieces.
 	Revisions []Snapshot `json:"-"`
+
+	// keys are the unlocked encryption keys (see Unlock)
+	keys *keyring
+	// lock is the repository lock held by this process, if any
+	lock *repoLock
+	// journal records the progress of the backup being taken
+	journal *journal
+	// rangeSlots limits the number of concurrent range downloads during a backup
+	rangeSlots chan struct{}
+	// brokenSnapshots maps the snapshot index files that failed to load to the errors
+	brokenSnapshots map[string]error
+	// saved maps the config and index objects to the hashes of their contents as last loaded or saved,
+	// so that only the changed ones are written again
+	saved map[string][sha256.Size]byte
+}
+
+// RepositoryOptions configures a new repository
+type RepositoryOptions struct {
+	// Chunking configures how blob data is split into FileBufs
+	Chunking chunker.Params
+	// Compression is the algorithm used for compressible FileBufs
+	Compression Compression
+	// ContentHash is the content address of FileBufs, unless the repository is encrypted
+	ContentHash ContentHash
+	// Secret is the passphrase or key file contents protecting the master key.
+	// If empty, the repository is not encrypted.
+	Secret []byte
 }
 
-func NewRepository(containerURL string, localPath string) (*Repository, error) {
-	err := os.MkdirAll(localPath, 0755)
+// configName is the name of the config object holding the repository metadata
+const configName = "info.json"
+
+func NewRepository(containerURL string, storage backend.Backend, options RepositoryOptions) (*Repository, error) {
+	err := options.Chunking.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = options.Compression.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = options.ContentHash.Validate()
 	if err != nil {
 		return nil, err
 	}
 
+	_, err = storage.Stat(backend.KindConfig, configName)
+	if err == nil {
+		return nil, fmt.Errorf("a repository already exists at %v", storage.Location())
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
 	result := &Repository{
 		ContainerURL: containerURL,
-		LocalPath:    localPath,
+		Chunking:     options.Chunking,
+		Compression:  options.Compression,
+		ContentHash:  options.ContentHash,
+		Backend:      storage,
 		Revisions:    nil,
 	}
 
+	if len(options.Secret) > 0 {
+		result.Encryption, result.keys, err = newEncryption(options.Secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = result.save()
 	if err != nil {
 		return nil, err
@@ -50,44 +129,69 @@ func NewRepository(containerURL string, localPath string) (*Repository, error) {
 	return result, nil
 }
 
-func OpenRepository(localPath string) (*Repository, error) {
+// OpenRepository loads an existing repository, taking a lock of the given mode first
+func OpenRepository(storage backend.Backend, mode LockMode) (*Repository, error) {
 	result := &Repository{
-		LocalPath: localPath,
+		Backend: storage,
 	}
 
-	err := result.load()
+	err := result.AcquireLock(mode)
 	if err != nil {
 		return nil, err
 	}
 
+	// Only an exclusive lock guarantees that no temporary object is in use
+	if cleaner, ok := storage.(backend.Cleaner); ok && mode == LockExclusive {
+		err = cleaner.Cleanup()
+		if err != nil {
+			_ = result.releaseLock()
+			return nil, err
+		}
+	}
+
+	err = result.load()
+	if err != nil {
+		_ = result.releaseLock()
+		return nil, err
+	}
+
 	return result, nil
 }
 
-func (r *Repository) save() error {
-	metadataFile, err := os.Create(filepath.Join(r.LocalPath, "info.json"))
-	if err != nil {
-		return err
+// Unlock decrypts the master key of an encrypted repository.
+// Must be called before any data is read or written. Does nothing for plaintext repositories.
+func (r *Repository) Unlock(secret []byte) error {
+	if r.Encryption == nil {
+		return nil
+	}
+
+	if len(secret) == 0 {
+		return fail.ErrRepositoryEncrypted
 	}
-	defer metadataFile.Close()
 
-	encoder := json.NewEncoder(metadataFile)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(r)
+	keys, err := r.Encryption.unlock(secret)
 	if err != nil {
 		return err
 	}
 
-	err = os.MkdirAll(filepath.Join(r.LocalPath, "snapshots"), 0755)
+	r.keys = keys
+	return nil
+}
+
+// save writes the config and the snapshot indices that have changed since they were loaded
+func (r *Repository) save() error {
+	data, err := r.marshalConfig()
 	if err != nil {
 		return err
 	}
-	err = os.MkdirAll(filepath.Join(r.LocalPath, "files"), 0755)
+
+	err = r.putChanged(backend.KindConfig, configName, data)
 	if err != nil {
 		return err
 	}
 
-	for _, snapshot := range r.Revisions {
-		err = snapshot.save()
+	for i := range r.Revisions {
+		err = r.saveSnapshot(&r.Revisions[i])
 		if err != nil {
 			return err
 		}
@@ -96,59 +200,217 @@ func (r *Repository) save() error {
 	return nil
 }
 
+func (r *Repository) saveSnapshot(snapshot *Snapshot) error {
+	data, err := snapshot.marshal()
+	if err != nil {
+		return err
+	}
+
+	return r.putChanged(backend.KindIndex, snapshot.IndexFile, data)
+}
+
+func (r *Repository) marshalConfig() ([]byte, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// putChanged stores an object, unless it's known to be stored with the same contents already.
+// Besides sparing the writes, this keeps append-only and immutable storage from rejecting them
+func (r *Repository) putChanged(kind backend.Kind, name string, data []byte) error {
+	saved, ok := r.saved[string(kind)+"/"+name]
+	if ok && saved == sha256.Sum256(data) {
+		return nil
+	}
+
+	err := r.Backend.Put(kind, name, data)
+	if err != nil {
+		return err
+	}
+
+	r.markSaved(kind, name, data)
+	return nil
+}
+
+// markSaved records the contents an object is stored with
+func (r *Repository) markSaved(kind backend.Kind, name string, data []byte) {
+	if r.saved == nil {
+		r.saved = make(map[string][sha256.Size]byte)
+	}
+
+	r.saved[string(kind)+"/"+name] = sha256.Sum256(data)
+}
+
 func (r *Repository) load() error {
-	metadataFile, err := os.Open(filepath.Join(r.LocalPath, "info.json"))
+	data, err := backend.ReadAll(r.Backend, backend.KindConfig, configName)
 	if err != nil {
 		return err
 	}
-	defer metadataFile.Close()
 
-	decoder := json.NewDecoder(metadataFile)
-	err = decoder.Decode(r)
+	err = json.Unmarshal(data, r)
 	if err != nil {
 		return err
 	}
 
-	snapshotDirs, err := os.ReadDir(filepath.Join(r.LocalPath, "snapshots"))
+	if r.Chunking.Algorithm == "" {
+		r.Chunking.Algorithm = chunker.AlgorithmNone
+	}
+	if r.Compression == "" {
+		r.Compression = CompressionNone
+	}
+	if r.ContentHash == "" {
+		r.ContentHash = ContentHashMD5
+	}
+
+	// The defaults filled in above needn't be written back unless something else changes
+	r.saved = nil
+	data, err = r.marshalConfig()
 	if err != nil {
 		return err
 	}
+	r.markSaved(backend.KindConfig, configName, data)
 
 	r.Revisions = nil
-	for _, snapshotIndex := range snapshotDirs {
+	r.brokenSnapshots = make(map[string]error)
+	for snapshotIndex, err := range r.Backend.List(backend.KindIndex) {
+		if err != nil {
+			return err
+		}
+
 		snapshot := Snapshot{
-			IndexFile: filepath.Join(r.LocalPath, "snapshots", snapshotIndex.Name()),
+			IndexFile: snapshotIndex.Name,
 		}
 
-		err = snapshot.load()
+		err = snapshot.load(r.Backend)
 		if err != nil {
 			log.Printf("Warning: Failed to load snapshot %q: %v", snapshot.IndexFile, err)
+			r.brokenSnapshots[snapshot.IndexFile] = err
 			continue
 		}
 
+		data, err := snapshot.marshal()
+		if err != nil {
+			return err
+		}
+		r.markSaved(backend.KindIndex, snapshot.IndexFile, data)
+
 		r.Revisions = append(r.Revisions, snapshot)
 	}
 
+	// The listing order is up to the backend
+	slices.SortFunc(r.Revisions, func(a, b Snapshot) int {
+		return strings.Compare(a.IndexFile, b.IndexFile)
+	})
+
 	return nil
 }
 
+// ReadChunking reads the chunking parameters of a repository without loading the rest of it
+func ReadChunking(storage backend.Backend) (chunker.Params, error) {
+	data, err := backend.ReadAll(storage, backend.KindConfig, configName)
+	if err != nil {
+		return chunker.Params{}, err
+	}
+
+	var config Repository
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return chunker.Params{}, err
+	}
+
+	if config.Chunking.Algorithm == "" {
+		config.Chunking.Algorithm = chunker.AlgorithmNone
+	}
+
+	return config.Chunking, nil
+}
+
+// Close saves the repository if it's locked exclusively, releases the lock and closes the backend
 func (r *Repository) Close() error {
-	return r.save()
+	var err error
+	// Without an exclusive lock, saving would race with whoever holds it
+	if r.holdsExclusiveLock() {
+		err = r.verifyLock()
+		if err == nil {
+			err = r.save()
+		}
+	}
+	return errors.Join(err, r.releaseLock(), r.Backend.Close())
+}
+
+// Discard releases the lock without saving, for repositories that failed to open completely
+func (r *Repository) Discard() error {
+	return errors.Join(r.releaseLock(), r.Backend.Close())
+}
+
+// SnapshotOptions configures a new backup
+type SnapshotOptions struct {
+	// Tags are attached to the saved snapshot
+	Tags []string
+	// Parallel is the number of blobs backed up concurrently
+	Parallel int
+	// ParallelRanges is the total number of concurrent range downloads
+	ParallelRanges int
+	// ParallelSnapshots is the number of online blob snapshots created concurrently
+	ParallelSnapshots int
+	// Consistency decides what is done about blobs modified while the online snapshot was being taken
+	Consistency ConsistencyMode
+	// ConsistencyRetries is the number of re-snapshot rounds allowed in the retry mode
+	ConsistencyRetries int
+	// Lease protects each blob from modification and deletion while it's being backed up
+	Lease bool
+	// Tolerant saves a partial snapshot instead of failing if some blobs fail to back up
+	Tolerant bool
+	// CarryForward includes the previous revisions of the failed blobs in a partial snapshot
+	CarryForward bool
+	// Resume continues an interrupted backup from its journal instead of starting a new one
+	Resume bool
+}
+
+// TakeSnapshot backs up the container. It's aborted if the repository lock is lost midway
+func (r *Repository) TakeSnapshot(ctx context.Context, options SnapshotOptions) error {
+	ctx, cancel := r.lockContext(ctx)
+	defer cancel()
+
+	return lockError(ctx, r.takeSnapshot(ctx, options))
 }
 
-func (r *Repository) TakeSnapshot(ctx context.Context) error {
+func (r *Repository) takeSnapshot(ctx context.Context, options SnapshotOptions) error {
 	success := false
 
+	if options.Consistency == "" {
+		options.Consistency = ConsistencyNone
+	}
+	err := options.Consistency.Validate()
+	if err != nil {
+		return err
+	}
+
 	client, err := azure.OpenClient(r.ContainerURL)
 	if err != nil {
 		return err
 	}
 
-	onlineSnapshot, err := azure.TakeSnapshot(ctx, client)
+	onlineSnapshot, err := r.beginBackup(ctx, client, &options)
 	if err != nil {
 		return err
 	}
-	defer onlineSnapshot.Delete(ctx) // TODO: Other context?
+	if onlineSnapshot == nil {
+		// The interrupted backup turned out to be complete
+		return nil
+	}
+	defer func() {
+		_ = r.journal.close()
+		r.journal = nil
+
+		if !success {
+			// The online snapshots are kept along with the journal
+			fmt.Printf("!! Backup interrupted, resume it with --resume or discard it with --abort\n")
+		}
+	}()
 
 	oldBlobLookup := make(map[string]Blob)
 	if len(r.Revisions) > 0 {
@@ -159,51 +421,297 @@ func (r *Repository) TakeSnapshot(ctx context.Context) error {
 		}
 	}
 
-	snapshotPath := filepath.Join(
-		r.LocalPath,
-		"snapshots",
-		onlineSnapshot.TakenAt.Format("20060102150405")+".json",
-	)
-	err = os.MkdirAll(filepath.Dir(snapshotPath), 0755)
-	if err != nil {
-		return err
+	// Note: the index is only written once the snapshot is complete
+	snapshot := Snapshot{
+		SavedAt:   onlineSnapshot.TakenAt,
+		IndexFile: onlineSnapshot.TakenAt.Format("20060102150405") + ".json",
+		Tags:      options.Tags,
+		// Note: re-snapshotting may have changed the skew
+		Skew:        onlineSnapshot.Skew,
+		Consistency: r.journal.start.Consistency,
+		Skipped:     slices.Clone(r.journal.start.Skipped),
+		// Each worker fills in its own slot, so the original order is preserved
+		Blobs: make(BlobList, len(onlineSnapshot.Blobs)),
 	}
-	// TODO: Maybe not remove the incomplete snapshot directory? Though then it would be loaded next time.
+
+	r.rangeSlots = make(chan struct{}, max(options.ParallelRanges, 1))
 	defer func() {
-		if !success {
-			_ = os.Remove(snapshotPath)
-		}
+		r.rangeSlots = nil
 	}()
 
-	snapshot := Snapshot{
-		SavedAt:   onlineSnapshot.TakenAt,
-		IndexFile: snapshotPath,
-		Blobs:     make(BlobList, 0, len(onlineSnapshot.Blobs)),
-	}
+	// The first error cancels the rest of the downloads through the group's context
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(max(options.Parallel, 1))
+
+	// Only used in the tolerant mode, filled in the same way as the blobs
+	failures := make([]*FailedBlob, len(onlineSnapshot.Blobs))
 
-	for _, blobInfo := range onlineSnapshot.Blobs {
-		// TODO: Also compare LastModified against TakenAt
-		// Note: If the (online) blob snapshot was modified after
-		// the (online) container snapshot was started,
-		// we should abort the process and try again.
-		// Also note that, if the blob is deleted before we've
+	for i, blobInfo := range onlineSnapshot.Blobs {
+		// Note: if the blob is deleted before we've
 		// finished backing it up, the snapshot is deleted too.
 
-		newBlob, err := r.backupBlob(ctx, client, blobInfo, oldBlobLookup[blobInfo.Name])
-		if err != nil {
-			return err
+		group.Go(func() error {
+			if done := r.journal.lookupBlob(r, blobInfo); done != nil {
+				snapshot.Blobs[i] = done
+				return nil
+			}
+
+			var newBlob Blob
+			var err error
+			if options.Lease {
+				newBlob, err = r.backupLeasedBlob(groupCtx, client, blobInfo, oldBlobLookup[blobInfo.Name])
+			} else {
+				newBlob, err = r.backupBlob(groupCtx, client, blobInfo, oldBlobLookup[blobInfo.Name])
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to back up %q: %w", blobInfo.Name, err)
+				// A cancellation is never specific to a single blob
+				if !options.Tolerant || groupCtx.Err() != nil {
+					return err
+				}
+
+				fmt.Printf("!! %v\n", err)
+				failures[i] = &FailedBlob{
+					Name:   blobInfo.Name,
+					Reason: err.Error(),
+				}
+
+				oldBlob := oldBlobLookup[blobInfo.Name]
+				if options.CarryForward && oldBlob != nil {
+					newBlob = oldBlob.ShallowClone()
+					failures[i].CarriedForward = true
+				}
+			} else if newBlob != nil {
+				err = r.journal.recordBlob(blobInfo, newBlob)
+				if err != nil {
+					return err
+				}
+			}
+
+			snapshot.Blobs[i] = newBlob
+			return nil
+		})
+	}
+
+	err = group.Wait()
+	if err != nil {
+		return err
+	}
+
+	for _, failure := range failures {
+		if failure != nil {
+			snapshot.Partial = true
+			snapshot.Failed = append(snapshot.Failed, *failure)
 		}
-		snapshot.Blobs = append(snapshot.Blobs, newBlob)
+	}
+
+	// Skipped and failed blobs leave holes behind
+	for i, blobInfo := range onlineSnapshot.Blobs {
+		if snapshot.Blobs[i] == nil && failures[i] == nil {
+			snapshot.Skipped = append(snapshot.Skipped, blobInfo.Name)
+		}
+	}
+	snapshot.Blobs = slices.DeleteFunc(snapshot.Blobs, func(blob Blob) bool {
+		return blob == nil
+	})
+
+	retainServerSnapshots(ctx, client, onlineSnapshot, &snapshot, oldBlobLookup)
+
+	err = snapshot.assignID()
+	if err != nil {
+		return err
+	}
+
+	// Whoever took the lock over mustn't find a new index appearing behind their back
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	// The index must be in place before the journal is gone
+	err = r.saveSnapshot(&snapshot)
+	if err != nil {
+		return err
 	}
 
 	r.Revisions = append(r.Revisions, snapshot)
-	fmt.Printf("!! Saved snapshot %q\n", snapshot.IndexFile)
+	fmt.Printf("!! Saved snapshot %v (%q), skew %v\n", snapshot.ID, snapshot.IndexFile, snapshot.Skew)
 
 	success = true
 
+	err = r.journal.remove()
+	if err != nil {
+		return err
+	}
+	onlineSnapshot.Delete(ctx)
+
+	if snapshot.Partial {
+		return fmt.Errorf("%w: %v blob(s) failed", fail.ErrPartialBackup, len(snapshot.Failed))
+	}
+
 	return nil
 }
 
+// retainServerSnapshots keeps the online snapshots that the new page blob backups
+// will be diffed against next time, and removes the ones retained previously
+// that are no longer needed
+func retainServerSnapshots(
+	ctx context.Context,
+	client *azcontainer.Client,
+	onlineSnapshot *azure.ContainerSnapshot,
+	snapshot *Snapshot,
+	oldBlobLookup map[string]Blob,
+) {
+	needed := serverSnapshots(snapshot)
+
+	for i := range onlineSnapshot.Blobs {
+		blobInfo := &onlineSnapshot.Blobs[i]
+		if needed[blobInfo.Name] == blobInfo.Snapshot {
+			blobInfo.Retained = true
+		}
+	}
+
+	for name, oldBlob := range oldBlobLookup {
+		pageBlob, ok := oldBlob.(*PageBlob)
+		if !ok || pageBlob.ServerSnapshot == "" || needed[name] == pageBlob.ServerSnapshot {
+			continue
+		}
+
+		// The blob might have been deleted already, which takes deleting its snapshots along with it
+		_ = azure.DeleteSnapshot(ctx, client, name, pageBlob.ServerSnapshot)
+	}
+}
+
+// serverSnapshots maps the page blobs of a snapshot to the online snapshots they are diffed against
+func serverSnapshots(snapshot *Snapshot) map[string]string {
+	result := make(map[string]string)
+	for _, blob := range snapshot.Blobs {
+		if pageBlob, ok := blob.(*PageBlob); ok && pageBlob.ServerSnapshot != "" {
+			result[pageBlob.Name] = pageBlob.ServerSnapshot
+		}
+	}
+
+	return result
+}
+
+// retainedBy marks the blob snapshots the revision's page blobs are diffed against as retained
+func retainedBy(revision *Snapshot, blobs []azure.BlobInfo) []azure.BlobInfo {
+	needed := serverSnapshots(revision)
+
+	result := slices.Clone(blobs)
+	for i := range result {
+		if needed[result[i].Name] == result[i].Snapshot {
+			result[i].Retained = true
+		}
+	}
+
+	return result
+}
+
+// beginBackup takes a new online snapshot and starts a journal for it or, when resuming, picks up the interrupted one.
+// Returns a nil snapshot if the interrupted backup had actually been saved already
+func (r *Repository) beginBackup(ctx context.Context, client *azcontainer.Client, options *SnapshotOptions) (*azure.ContainerSnapshot, error) {
+	if !options.Resume {
+		pending, err := hasJournal(r.Backend)
+		if err != nil {
+			return nil, err
+		}
+		if pending {
+			return nil, fail.ErrInterruptedBackup
+		}
+
+		onlineSnapshot, deleted, err := azure.TakeSnapshot(ctx, client, options.ParallelSnapshots)
+		if err != nil {
+			return nil, err
+		}
+
+		consistency, resnapshotDeleted, err := checkConsistency(ctx, onlineSnapshot, options.Consistency, options.ConsistencyRetries)
+		if err == nil {
+			r.journal, err = createJournal(r.Backend, journalStart{
+				TakenAt:     onlineSnapshot.TakenAt,
+				Tags:        options.Tags,
+				Consistency: consistency,
+				Blobs:       onlineSnapshot.Blobs,
+				Skipped:     append(deleted, resnapshotDeleted...),
+			})
+		}
+		if err != nil {
+			onlineSnapshot.Delete(ctx)
+			return nil, err
+		}
+
+		return onlineSnapshot, nil
+	}
+
+	pending, err := readJournal(r.Backend)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fail.ErrNoInterruptedBackup
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start := pending.start
+	for _, revision := range r.Revisions {
+		if revision.SavedAt.Equal(start.TakenAt) {
+			fmt.Printf("!! The interrupted backup was saved as %v already, cleaning up\n", revision.ID)
+			azure.DeleteSnapshots(ctx, client, retainedBy(&revision, start.Blobs), options.ParallelSnapshots)
+			return nil, pending.remove()
+		}
+	}
+
+	onlineSnapshot, deleted, err := azure.ResumeSnapshot(ctx, client, start.TakenAt, start.Blobs, options.ParallelSnapshots)
+	if err != nil {
+		_ = pending.close()
+		return nil, err
+	}
+
+	// Some blob snapshots might have been replaced, and an abort has to know about the new ones
+	start.Blobs = onlineSnapshot.Blobs
+	start.Skipped = append(start.Skipped, deleted...)
+	err = pending.append(journalEntry{Start: &start})
+	if err == nil {
+		err = pending.flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	pending.start = start
+
+	fmt.Printf("!! Resuming the backup from %v, %v blob(s) done already\n", start.TakenAt.Local().Format(time.DateTime), len(pending.blobs))
+
+	options.Tags = start.Tags
+	r.journal = pending
+	return onlineSnapshot, nil
+}
+
+// backupLeasedBlob backs up a blob while holding a lease on it. Returns a nil blob if it has been deleted before it could be leased.
+// If someone else holds a lease on it already, it is backed up without protection
+func (r *Repository) backupLeasedBlob(ctx context.Context, client *azcontainer.Client, blobInfo azure.BlobInfo, oldBlob Blob) (Blob, error) {
+	blobLease, err := azure.AcquireLease(ctx, client, blobInfo.Name)
+	switch {
+	case bloberror.HasCode(err, bloberror.BlobNotFound):
+		fmt.Printf("!! Skipping %q: deleted before it could be leased\n", blobInfo.Name)
+		return nil, nil
+	case bloberror.HasCode(err, bloberror.LeaseAlreadyPresent):
+		fmt.Printf("!! %q is leased by someone else, backing it up unprotected\n", blobInfo.Name)
+	case err != nil:
+		return nil, err
+	default:
+		defer func() {
+			// The lease would expire on its own anyway
+			_ = blobLease.Release(context.WithoutCancel(ctx))
+		}()
+	}
+
+	newBlob, err := r.backupBlob(ctx, client, blobInfo, oldBlob)
+	if blobLease == nil && bloberror.HasCode(err, bloberror.BlobNotFound) {
+		fmt.Printf("!! Skipping %q: deleted while being backed up unprotected\n", blobInfo.Name)
+		return nil, nil
+	}
+
+	return newBlob, err
+}
+
 func (r *Repository) backupBlob(
 	ctx context.Context,
 	client *azcontainer.Client,
@@ -231,8 +739,9 @@ func (r *Repository) backupBlob(
 	}
 
 	// 2. The blob is unchanged since last time.
-	// TODO: This doesn't account for changed metadata! Perhaps also see LastModified?
-	if slices.Equal(oldBlob.Common().ContentMD5, newBlobProps.ContentMD5) {
+	// Note: page and append blobs usually have no MD5, so the ETag is what
+	// actually tells us about modifications (including the metadata ones)
+	if oldBlob.Common().ETag == string(*newBlobProps.ETag) && slices.Equal(oldBlob.Common().ContentMD5, newBlobProps.ContentMD5) {
 		blob := oldBlob.ShallowClone()
 		return blob, nil
 	}
@@ -242,52 +751,149 @@ func (r *Repository) backupBlob(
 	return blob, err
 }
 
-func (r *Repository) DownloadBlobRangeAsFileBuf(
+// forEachRange calls fn for every index in [0, count), downloading up to
+// the configured number of ranges concurrently. Stops at the first error.
+func (r *Repository) forEachRange(ctx context.Context, count int, fn func(ctx context.Context, i int) error) error {
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(max(cap(r.rangeSlots), 1))
+
+	for i := range count {
+		group.Go(func() error {
+			return fn(groupCtx, i)
+		})
+	}
+
+	return group.Wait()
+}
+
+// DownloadBlobRange downloads a range of a blob of any size and stores it as content-defined chunks.
+// Also returns the MD5 hash of the whole range, computed locally.
+func (r *Repository) DownloadBlobRange(
 	ctx context.Context,
 	client *azblob.Client,
 	offset uint64,
 	size uint64,
-) (*FileBuf, error) {
-	if size > 4*1024*1024 {
-		// TODO: Perhaps correct somehow? Worst case, we'll need to download and recompute everything, which is unpleasant
-		log.Printf("Warning: Attempt to download large blob range (%v bytes). ContentMD5 might not work in these scenarios.", size)
-	}
-
-	stream, err := client.DownloadStream(ctx, &azblob.DownloadStreamOptions{
-		Range: azblob.HTTPRange{
-			Offset: int64(offset),
-			Count:  int64(size),
-		},
-		RangeGetContentMD5: azure.Addressof(true),
-	})
+) (ChunkList, []byte, error) {
+	if r.journal != nil {
+		if done := r.journal.lookupRange(r, client.URL(), offset, size); done != nil {
+			return done.Content, done.ContentMD5, nil
+		}
+	}
+
+	if r.rangeSlots != nil {
+		// The slots are shared between all blobs being backed up
+		select {
+		case r.rangeSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		defer func() {
+			<-r.rangeSlots
+		}()
+	}
+
+	if size == 0 {
+		// A zero count would mean "until the end of the blob"
+		emptyMD5 := md5.Sum(nil)
+		return ChunkList{}, emptyMD5[:], nil
+	}
+
+	// Large ranges (up to 4000 MiB for a block) are fetched piece by piece
+	stream := newRangeReader(ctx, client, offset, size)
+	defer stream.Close()
+
+	rangeHash := md5.New()
+
+	chunks, err := chunker.New(io.TeeReader(stream, rangeHash), r.Chunking)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	result := make(ChunkList, 0, 1)
+
+	for {
+		data, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fb, err := r.storeChunk(data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		result = append(result, fb)
+	}
+
+	rangeMD5 := rangeHash.Sum(nil)
+
+	if r.journal != nil {
+		err = r.journal.recordRange(client.URL(), offset, size, result, rangeMD5)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return result, rangeMD5, nil
+}
+
+// chunkID computes the content address of a piece of data:
+// the configured plain hash for unencrypted repositories, a keyed hash otherwise.
+func (r *Repository) chunkID(data []byte) ([]byte, error) {
+	if r.Encryption == nil {
+		return r.ContentHash.sum(data), nil
 	}
-	defer stream.Body.Close()
 
-	contentMD5 := stream.ContentMD5
+	if r.keys == nil {
+		return nil, fail.ErrRepositoryEncrypted
+	}
+
+	return r.keys.chunkID(data), nil
+}
 
-	if uint64(*stream.ContentLength) != size {
-		panic(fmt.Sprintf("unexpected returned size: want %v, got %v", size, *stream.ContentLength))
+// storeChunk saves a piece of data as a FileBuf, unless an identical one is already stored
+func (r *Repository) storeChunk(data []byte) (*FileBuf, error) {
+	id, err := r.chunkID(data)
+	if err != nil {
+		return nil, err
 	}
 
-	fb := NewFileBuf(contentMD5, size)
+	fb := NewFileBuf(id, uint64(len(data)))
 
-	err = os.MkdirAll(filepath.Dir(fb.Path(r.LocalPath)), 0755)
+	fb.Compression, data, err = compress(r.Compression, data)
 	if err != nil {
 		return nil, err
 	}
 
-	file, err := os.OpenFile(fb.Path(r.LocalPath), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
-	if errors.Is(err, os.ErrExist) {
+	if r.keys != nil {
+		data, err = r.keys.seal(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fb.StoredSize = uint64(len(data))
+
+	// An object of the wrong size could only have been left by a crash before writes became atomic.
+	// Reading it back would double the traffic of every backup, so that's left to check --read-data
+	info, err := r.Backend.Stat(backend.KindData, fb.ID)
+	if err == nil && uint64(info.Size) == fb.StoredSize {
 		return fb, nil
 	}
+	if err == nil {
+		fmt.Printf("!! Replacing FileBuf %v: stored size is %v bytes, want %v\n", fb.ID, info.Size, fb.StoredSize)
+	}
+
+	// Whatever ends up under the content address must decode to exactly the same content
+	err = r.verifyChunk(fb, data)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("FileBuf %v failed verification before being stored: %w", fb.ID, err)
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, stream.Body)
+	err = r.Backend.Put(backend.KindData, fb.ID, data)
 	if err != nil {
 		return nil, err
 	}
@@ -295,4 +901,103 @@ func (r *Repository) DownloadBlobRangeAsFileBuf(
 	return fb, nil
 }
 
-// TODO: Manual garbage collection for FileBufs!
+// verifyChunk checks that the stored representation of a FileBuf decodes to content matching its ID
+func (r *Repository) verifyChunk(fb *FileBuf, data []byte) error {
+	if uint64(len(data)) != fb.StoredSize {
+		return fmt.Errorf("stored size is %v bytes, expected %v", len(data), fb.StoredSize)
+	}
+
+	content, err := r.decodeChunk(fb, data)
+	if err != nil {
+		return err
+	}
+
+	contentID, err := r.chunkID(content)
+	if err != nil {
+		return err
+	}
+
+	if NewFileBuf(contentID, uint64(len(content))).ID != fb.ID {
+		return errors.New("content doesn't match the ID")
+	}
+
+	return nil
+}
+
+// openChunk opens a stored FileBuf for reading, decrypting and decompressing it if necessary
+func (r *Repository) openChunk(fb *FileBuf) (io.ReadCloser, error) {
+	if r.Encryption == nil && fb.IsRaw() {
+		return r.Backend.Get(backend.KindData, fb.ID)
+	}
+
+	if r.Encryption != nil && r.keys == nil {
+		return nil, fail.ErrRepositoryEncrypted
+	}
+
+	data, err := backend.ReadAll(r.Backend, backend.KindData, fb.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = r.decodeChunk(fb, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// decodeChunk turns the stored representation of a FileBuf back into its content
+func (r *Repository) decodeChunk(fb *FileBuf, data []byte) ([]byte, error) {
+	var err error
+
+	if r.keys != nil {
+		data, err = r.keys.open(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt FileBuf %v: %w", fb.ID, err)
+		}
+	}
+
+	data, err = decompress(fb.Compression, data, fb.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress FileBuf %v: %w", fb.ID, err)
+	}
+
+	return data, nil
+}
+
+// RepositoryStats summarizes the space used by a repository
+type RepositoryStats struct {
+	Snapshots int
+	// FileBufs is the number of distinct FileBufs referenced by the snapshots
+	FileBufs int
+	// LogicalSize is the total size of the distinct FileBufs before compression
+	LogicalSize uint64
+	// StoredSize is the total size of the distinct FileBufs on disk
+	StoredSize uint64
+}
+
+func (r *Repository) Stats() RepositoryStats {
+	result := RepositoryStats{
+		Snapshots: len(r.Revisions),
+	}
+
+	seen := make(map[string]struct{})
+
+	for _, snapshot := range r.Revisions {
+		for _, blob := range snapshot.Blobs {
+			for fb := range blob.FileBufs() {
+				if _, ok := seen[fb.ID]; ok {
+					continue
+				}
+				seen[fb.ID] = struct{}{}
+
+				result.FileBufs++
+				result.LogicalSize += fb.Size
+				result.StoredSize += fb.StoredSizeOrSize()
+			}
+		}
+	}
+
+	return result
+}
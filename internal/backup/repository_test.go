@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+// writeOnly is a backend whose FileBufs can't be read back, like archived storage
+type writeOnly struct {
+	backend.Backend
+	puts int
+}
+
+func (w *writeOnly) Put(kind backend.Kind, name string, data []byte) error {
+	w.puts++
+	return w.Backend.Put(kind, name, data)
+}
+
+func (w *writeOnly) Get(kind backend.Kind, name string) (io.ReadCloser, error) {
+	if kind == backend.KindData {
+		return nil, errors.New("FileBufs can't be read back")
+	}
+
+	return w.Backend.Get(kind, name)
+}
+
+func TestStoreChunk(t *testing.T) {
+	_, keys, err := newEncryption([]byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		repo Repository
+	}{
+		{"plain", Repository{ContentHash: ContentHashSHA256, Compression: CompressionNone}},
+		{"compressed", Repository{ContentHash: ContentHashSHA256, Compression: CompressionZstd}},
+		{"encrypted", Repository{Compression: CompressionZstd, Encryption: &EncryptionConfig{}, keys: keys}},
+	}
+
+	data := bytes.Repeat([]byte("some chunk contents "), 1000)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local := backend.NewLocal(t.TempDir())
+			storage := &writeOnly{Backend: local}
+			repo := test.repo
+			repo.Backend = storage
+
+			// Storing a chunk, even an already stored one, mustn't read anything back
+			fb, err := repo.storeChunk(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := repo.storeChunk(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if again.ID != fb.ID || again.StoredSize != fb.StoredSize {
+				t.Errorf("stored the same chunk as %+v, then %+v", fb, again)
+			}
+			if storage.puts != 1 {
+				t.Errorf("stored the same chunk %v times", storage.puts)
+			}
+
+			repo.Backend = local
+			reader, err := repo.openChunk(fb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			stored, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, data) {
+				t.Error("stored chunk differs from the original")
+			}
+		})
+	}
+}
+
+// archive is a backend that stores the FileBufs offline
+type archive struct {
+	writeOnly
+}
+
+func (a *archive) Archives(kind backend.Kind) bool {
+	return kind == backend.KindData
+}
+
+func TestArchivedData(t *testing.T) {
+	storage := &archive{writeOnly{Backend: backend.NewLocal(t.TempDir())}}
+	repo := &Repository{ContentHash: ContentHashSHA256, Compression: CompressionNone, Backend: storage}
+
+	referenced, err := repo.storeChunk([]byte("referenced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage, err := repo.storeChunk([]byte("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo.Revisions = []Snapshot{{
+		Blobs: BlobList{&AppendBlob{Fragments: AppendFragmentList{{Content: ChunkList{referenced}}}}},
+	}}
+
+	report := repo.Check(context.Background(), CheckOptions{ReadData: true})
+	if report.OK() || report.FileBufsRead != 0 {
+		t.Errorf("check read %v archived FileBuf(s) with errors %v, want none read and an error", report.FileBufsRead, report.Errors)
+	}
+
+	err = repo.AcquireLock(LockExclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.releaseLock()
+
+	_, err = repo.CollectGarbage(context.Background(), GCOptions{Quarantine: true})
+	if !errors.Is(err, fail.ErrArchived) {
+		t.Errorf("gc with quarantine: got %v, want %v", err, fail.ErrArchived)
+	}
+
+	// Deleting doesn't need the data
+	_, err = repo.CollectGarbage(context.Background(), GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.Stat(backend.KindData, garbage.ID)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("garbage is still stored: %v", err)
+	}
+	_, err = storage.Stat(backend.KindData, referenced.ID)
+	if err != nil {
+		t.Errorf("referenced FileBuf is gone: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/abel1502/mipt-kp-m-test/internal/azure"
+	"github.com/gobwas/glob"
+)
+
+// maxUploadPieceSize is the largest body accepted by UploadPages and AppendBlock
+const maxUploadPieceSize = 4 * 1024 * 1024
+
+type RestoreOptions struct {
+	// Overwrite replaces blobs that already exist in the target container. Otherwise they are skipped
+	Overwrite bool
+}
+
+// RestoreByGlob recreates the matching blobs in the target container, preserving their types
+func (s *Snapshot) RestoreByGlob(
+	ctx context.Context,
+	repo *Repository,
+	targets glob.Glob,
+	client *azcontainer.Client,
+	options RestoreOptions,
+) error {
+	for _, blob := range s.Blobs {
+		blobName := blob.Common().Name
+
+		if !targets.Match(blobName) {
+			continue
+		}
+
+		// Spares the upload of the blobs to skip in the common case. Whether one is really created is decided by the condition below
+		existing, err := existingBlob(ctx, client, blobName)
+		if err != nil {
+			return err
+		}
+
+		var conditions *azblob.AccessConditions
+		if !options.Overwrite {
+			if existing != nil {
+				log.Printf("Skipped %q: already exists", blobName)
+				continue
+			}
+
+			conditions = &azblob.AccessConditions{
+				ModifiedAccessConditions: &azblob.ModifiedAccessConditions{
+					IfNoneMatch: azure.Addressof(azcore.ETagAny),
+				},
+			}
+		} else if existing != nil && existing.BlobType != nil && *existing.BlobType != blob.Type() {
+			// A blob can only be rewritten in place with the operations of its own type
+			_, err = client.NewBlobClient(blobName).Delete(ctx, &azblob.DeleteOptions{
+				AccessConditions: &azblob.AccessConditions{
+					ModifiedAccessConditions: &azblob.ModifiedAccessConditions{
+						IfMatch: existing.ETag,
+					},
+				},
+			})
+			if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+				return err
+			}
+		}
+
+		err = blob.Restore(ctx, repo, client, conditions)
+		if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+			log.Printf("Skipped %q: created in the meantime", blobName)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Restored %q", blobName)
+	}
+
+	return nil
+}
+
+// existingBlob returns the properties of a blob in the target container, or nil if there's none
+func existingBlob(ctx context.Context, client *azcontainer.Client, name string) (*azblob.GetPropertiesResponse, error) {
+	props, err := client.NewBlobClient(name).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &props, nil
+}
+
+// restoreHeaders are the HTTP headers to recreate the blob with
+func (c *CommonBlob) restoreHeaders() *azblob.HTTPHeaders {
+	return &azblob.HTTPHeaders{
+		BlobContentMD5: c.ContentMD5,
+	}
+}
+
+// forEachPiece splits the data into pieces small enough for a single upload request
+func forEachPiece(reader io.Reader, fn func(offset uint64, piece []byte) error) error {
+	buf := make([]byte, maxUploadPieceSize)
+	offset := uint64(0)
+
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			fnErr := fn(offset, buf[:n])
+			if fnErr != nil {
+				return fnErr
+			}
+			offset += uint64(n)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
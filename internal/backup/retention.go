@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/abel1502/mipt-kp-m-test/internal/azure"
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
+)
+
+// RetentionPolicy decides which snapshots to keep. A snapshot is kept
+// if any of the rules selects it; everything else is forgotten.
+type RetentionPolicy struct {
+	// Last keeps the N most recent snapshots
+	Last int
+	// Hourly, Daily, Weekly, Monthly and Yearly keep the most recent snapshot
+	// in each of the last N hours/days/weeks/months/years that have one
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	// Within keeps all snapshots taken within this duration before the latest one
+	Within time.Duration
+	// Tags keeps all snapshots that have any of these tags
+	Tags []string
+}
+
+func (p RetentionPolicy) IsEmpty() bool {
+	return p.Last == 0 && p.Hourly == 0 && p.Daily == 0 && p.Weekly == 0 &&
+		p.Monthly == 0 && p.Yearly == 0 && p.Within == 0 && len(p.Tags) == 0
+}
+
+// RetentionDecision is the verdict of a RetentionPolicy for a single snapshot
+type RetentionDecision struct {
+	Snapshot *Snapshot
+	Keep     bool
+	// Reasons lists the rules that keep the snapshot
+	Reasons []string
+}
+
+type retentionBucket struct {
+	name  string
+	count int
+	key   func(t time.Time) string
+}
+
+// Apply evaluates the policy. The decisions are returned newest first.
+func (p RetentionPolicy) Apply(snapshots []Snapshot) []RetentionDecision {
+	result := make([]RetentionDecision, 0, len(snapshots))
+	for i := range snapshots {
+		result = append(result, RetentionDecision{Snapshot: &snapshots[i]})
+	}
+
+	slices.SortStableFunc(result, func(a, b RetentionDecision) int {
+		return b.Snapshot.SavedAt.Compare(a.Snapshot.SavedAt)
+	})
+
+	if len(result) == 0 {
+		return result
+	}
+
+	keep := func(decision *RetentionDecision, reason string) {
+		decision.Keep = true
+		decision.Reasons = append(decision.Reasons, reason)
+	}
+
+	for i := range min(p.Last, len(result)) {
+		keep(&result[i], "last")
+	}
+
+	buckets := []retentionBucket{
+		{"hourly", p.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%04d-W%02d", year, week)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	for _, bucket := range buckets {
+		lastKey := ""
+		left := bucket.count
+
+		for i := range result {
+			if left <= 0 {
+				break
+			}
+
+			key := bucket.key(result[i].Snapshot.SavedAt.Local())
+			if key == lastKey {
+				continue
+			}
+			lastKey = key
+
+			keep(&result[i], bucket.name)
+			left--
+		}
+	}
+
+	if p.Within > 0 {
+		threshold := result[0].Snapshot.SavedAt.Add(-p.Within)
+
+		for i := range result {
+			if !result[i].Snapshot.SavedAt.Before(threshold) {
+				keep(&result[i], "within "+p.Within.String())
+			}
+		}
+	}
+
+	for i := range result {
+		for _, tag := range p.Tags {
+			if slices.Contains(result[i].Snapshot.Tags, tag) {
+				keep(&result[i], "tagged "+tag)
+			}
+		}
+	}
+
+	return result
+}
+
+// Forget removes the snapshots not selected by the policy.
+// The FileBufs that become unreferenced are left for CollectGarbage.
+func (r *Repository) Forget(ctx context.Context, policy RetentionPolicy, dryRun bool) ([]RetentionDecision, error) {
+	if policy.IsEmpty() {
+		return nil, errors.New("empty retention policy would forget every snapshot")
+	}
+
+	if !r.holdsExclusiveLock() {
+		return nil, errors.New("forgetting snapshots requires an exclusive repository lock")
+	}
+
+	decisions := policy.Apply(r.Revisions)
+	if dryRun {
+		return decisions, nil
+	}
+
+	forgetting := slices.ContainsFunc(decisions, func(decision RetentionDecision) bool {
+		return !decision.Keep
+	})
+	if forgetting {
+		err := r.checkDeletable(backend.KindIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := r.lockContext(ctx)
+	defer cancel()
+
+	forgotten := make(map[string]struct{})
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+
+		err := r.Backend.Delete(backend.KindIndex, decision.Snapshot.IndexFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		forgotten[decision.Snapshot.IndexFile] = struct{}{}
+	}
+
+	// The decisions point into r.Revisions, so detach them before it's modified
+	for i := range decisions {
+		snapshot := *decisions[i].Snapshot
+		decisions[i].Snapshot = &snapshot
+	}
+
+	r.Revisions = slices.DeleteFunc(r.Revisions, func(snapshot Snapshot) bool {
+		_, ok := forgotten[snapshot.IndexFile]
+		return ok
+	})
+
+	r.releaseServerSnapshots(ctx, decisions)
+
+	return decisions, nil
+}
+
+// releaseServerSnapshots deletes the online snapshots retained for the page blobs
+// of the forgotten revisions, unless a remaining revision still diffs against them
+func (r *Repository) releaseServerSnapshots(ctx context.Context, decisions []RetentionDecision) {
+	type serverSnapshot struct {
+		blob     string
+		snapshot string
+	}
+
+	referenced := make(map[serverSnapshot]struct{})
+	for _, revision := range r.Revisions {
+		for _, blob := range revision.Blobs {
+			if pageBlob, ok := blob.(*PageBlob); ok && pageBlob.ServerSnapshot != "" {
+				referenced[serverSnapshot{pageBlob.Name, pageBlob.ServerSnapshot}] = struct{}{}
+			}
+		}
+	}
+
+	released := make(map[serverSnapshot]struct{})
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+
+		for _, blob := range decision.Snapshot.Blobs {
+			pageBlob, ok := blob.(*PageBlob)
+			if !ok || pageBlob.ServerSnapshot == "" {
+				continue
+			}
+
+			key := serverSnapshot{pageBlob.Name, pageBlob.ServerSnapshot}
+			if _, ok := referenced[key]; !ok {
+				released[key] = struct{}{}
+			}
+		}
+	}
+
+	if len(released) == 0 {
+		return
+	}
+
+	client, err := azure.OpenClient(r.ContainerURL)
+	if err != nil {
+		log.Printf("Warning: Failed to delete %v retained blob snapshot(s): %v", len(released), err)
+		return
+	}
+
+	for key := range released {
+		err = azure.DeleteSnapshot(ctx, client, key.blob, key.snapshot)
+		// The blob might have been deleted already, which takes deleting its snapshots along with it
+		if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			log.Printf("Warning: Failed to delete the retained snapshot %q of %q: %v", key.snapshot, key.blob, err)
+		}
+	}
+}
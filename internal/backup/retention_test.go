@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.Local)
+	}
+
+	// March 15 is a Sunday, so the last two days fall into different ISO weeks
+	snapshots := []Snapshot{
+		{ID: "1", SavedAt: at(time.January, 1, 10, 0), Tags: []string{"keep"}},
+		{ID: "2", SavedAt: at(time.March, 15, 9, 0)},
+		{ID: "3", SavedAt: at(time.March, 15, 18, 0)},
+		{ID: "4", SavedAt: at(time.March, 16, 8, 0)},
+		{ID: "5", SavedAt: at(time.March, 16, 8, 30)},
+		{ID: "6", SavedAt: at(time.March, 16, 9, 0)},
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		// want maps the IDs of the kept snapshots to the reasons
+		want map[string][]string
+	}{
+		{"last", RetentionPolicy{Last: 2}, map[string][]string{
+			"6": {"last"},
+			"5": {"last"},
+		}},
+		{"hourly", RetentionPolicy{Hourly: 2}, map[string][]string{
+			"6": {"hourly"},
+			"5": {"hourly"},
+		}},
+		{"daily", RetentionPolicy{Daily: 2}, map[string][]string{
+			"6": {"daily"},
+			"3": {"daily"},
+		}},
+		{"weekly", RetentionPolicy{Weekly: 2}, map[string][]string{
+			"6": {"weekly"},
+			"3": {"weekly"},
+		}},
+		{"monthly", RetentionPolicy{Monthly: 3}, map[string][]string{
+			"6": {"monthly"},
+			"1": {"monthly"},
+		}},
+		{"yearly", RetentionPolicy{Yearly: 1}, map[string][]string{
+			"6": {"yearly"},
+		}},
+		{"within", RetentionPolicy{Within: time.Hour}, map[string][]string{
+			"6": {"within 1h0m0s"},
+			"5": {"within 1h0m0s"},
+			"4": {"within 1h0m0s"},
+		}},
+		{"tags", RetentionPolicy{Tags: []string{"keep", "missing"}}, map[string][]string{
+			"1": {"tagged keep"},
+		}},
+		{"combined", RetentionPolicy{Last: 1, Daily: 2, Tags: []string{"keep"}}, map[string][]string{
+			"6": {"last", "daily"},
+			"3": {"daily"},
+			"1": {"tagged keep"},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decisions := test.policy.Apply(snapshots)
+			if len(decisions) != len(snapshots) {
+				t.Fatalf("got %v decisions, want %v", len(decisions), len(snapshots))
+			}
+
+			for i, decision := range decisions {
+				if i > 0 && decision.Snapshot.SavedAt.After(decisions[i-1].Snapshot.SavedAt) {
+					t.Errorf("decisions aren't sorted newest first")
+				}
+
+				want := test.want[decision.Snapshot.ID]
+				if decision.Keep != (len(want) > 0) || !reflect.DeepEqual(decision.Reasons, want) {
+					t.Errorf("snapshot %v: keep = %v, reasons = %v, want %v", decision.Snapshot.ID, decision.Keep, decision.Reasons, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+// snapshotTimeFormat is used for the index file names and accepted as a snapshot reference
+const snapshotTimeFormat = "20060102150405"
+
+// timeFormats are the accepted formats for user-provided points in time
+var timeFormats = []string{
+	time.RFC3339,
+	time.DateTime,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	time.DateOnly,
+	snapshotTimeFormat,
+}
+
+// ParseTime parses a user-provided point in time. Times without a zone are local
+func ParseTime(value string) (time.Time, error) {
+	for _, format := range timeFormats {
+		result, err := time.ParseInLocation(format, value, time.Local)
+		if err == nil {
+			return result, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// FindSnapshot resolves a snapshot reference: "latest", "latest~N",
+// the time the snapshot was taken at, or a (prefix of a) snapshot ID.
+// Times take precedence, and purely numeric ID prefixes have to be longer than a time.
+func (r *Repository) FindSnapshot(ref string) (*Snapshot, error) {
+	if len(r.Revisions) == 0 {
+		return nil, fail.ErrNoSnapshots
+	}
+
+	if ref == "" || ref == "latest" {
+		return &r.Revisions[len(r.Revisions)-1], nil
+	}
+
+	if back, ok := strings.CutPrefix(ref, "latest~"); ok {
+		n, err := strconv.Atoi(back)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid snapshot reference %q", ref)
+		}
+
+		if n >= len(r.Revisions) {
+			return nil, fmt.Errorf("%w: %q (only %v snapshots)", fail.ErrSnapshotNotFound, ref, len(r.Revisions))
+		}
+
+		return &r.Revisions[len(r.Revisions)-1-n], nil
+	}
+
+	savedAt, err := ParseTime(ref)
+	if err == nil {
+		for i := range r.Revisions {
+			if r.Revisions[i].SavedAt.Truncate(time.Second).Equal(savedAt) {
+				return &r.Revisions[i], nil
+			}
+		}
+
+		return nil, fmt.Errorf("%w: none taken at %v", fail.ErrSnapshotNotFound, savedAt.Format(time.DateTime))
+	}
+
+	// Short numeric references are most likely mistyped times, not ID prefixes
+	if isDigits(ref) && len(ref) <= len(snapshotTimeFormat) {
+		return nil, fmt.Errorf("%w: %q is neither a valid time nor a long enough ID prefix", fail.ErrSnapshotNotFound, ref)
+	}
+
+	var found *Snapshot
+	for i := range r.Revisions {
+		if !strings.HasPrefix(r.Revisions[i].ID, ref) {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("%w: %q", fail.ErrAmbiguousSnapshot, ref)
+		}
+		found = &r.Revisions[i]
+	}
+	if found != nil {
+		return found, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", fail.ErrSnapshotNotFound, ref)
+}
+
+func isDigits(value string) bool {
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SnapshotAt finds the newest snapshot taken at or before the given time
+func (r *Repository) SnapshotAt(at time.Time) (*Snapshot, error) {
+	var found *Snapshot
+	for i := range r.Revisions {
+		snapshot := &r.Revisions[i]
+		if snapshot.SavedAt.After(at) {
+			continue
+		}
+
+		if found == nil || snapshot.SavedAt.After(found.SavedAt) {
+			found = snapshot
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("%w: none taken at or before %v", fail.ErrSnapshotNotFound, at)
+	}
+
+	return found, nil
+}
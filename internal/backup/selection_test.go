@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abel1502/mipt-kp-m-test/internal/fail"
+)
+
+func TestFindSnapshot(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2026, time.October, 18, hour, 0, 0, 0, time.Local)
+	}
+
+	repo := &Repository{
+		Revisions: []Snapshot{
+			{ID: "ab23456789abcdef", SavedAt: at(12)},
+			{ID: "abcd456789abcdef", SavedAt: at(13)},
+			// Starts like the time of the previous snapshot
+			{ID: "20261018130000ff", SavedAt: at(14)},
+		},
+	}
+
+	tests := []struct {
+		ref  string
+		want string
+		err  error
+	}{
+		{"", "20261018130000ff", nil},
+		{"latest", "20261018130000ff", nil},
+		{"latest~1", "abcd456789abcdef", nil},
+		{"latest~3", "", fail.ErrSnapshotNotFound},
+		{"2026-10-18 12:00:00", "ab23456789abcdef", nil},
+		{"20261018120000", "ab23456789abcdef", nil},
+		{"20261018130000", "abcd456789abcdef", nil},
+		{"2026-10-18 15:00", "", fail.ErrSnapshotNotFound},
+		{"ab2", "ab23456789abcdef", nil},
+		{"ab", "", fail.ErrAmbiguousSnapshot},
+		// Short numeric references are taken for mistyped times
+		{"0123", "", fail.ErrSnapshotNotFound},
+		{"2026101813", "", fail.ErrSnapshotNotFound},
+		{"20261018130000f", "20261018130000ff", nil},
+		{"ffff", "", fail.ErrSnapshotNotFound},
+	}
+
+	for _, test := range tests {
+		snapshot, err := repo.FindSnapshot(test.ref)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("FindSnapshot(%q): got %v, want %v", test.ref, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("FindSnapshot(%q): %v", test.ref, err)
+			continue
+		}
+		if snapshot.ID != test.want {
+			t.Errorf("FindSnapshot(%q) = %v, want %v", test.ref, snapshot.ID, test.want)
+		}
+	}
+
+	_, err := (&Repository{}).FindSnapshot("latest")
+	if !errors.Is(err, fail.ErrNoSnapshots) {
+		t.Errorf("FindSnapshot in an empty repository: got %v, want %v", err, fail.ErrNoSnapshots)
+	}
+}
@@ -2,6 +2,8 @@ package backup
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,17 +14,41 @@ import (
 	"time"
 
 	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/abel1502/mipt-kp-m-test/internal/backend"
 	"github.com/gobwas/glob"
 )
 
 type Snapshot struct {
+	// ID is a short hash of the index, assigned when the snapshot is taken
+	ID string `json:"id"`
 	// SavedAt is the time at which this container backup was taken
 	SavedAt time.Time `json:"saved_at"`
-	// IndexFile is the path to the snapshot's index file.
+	// IndexFile is the name of the snapshot's index object.
 	// The composition of the saved blobs is saved there, but not the actual contents
 	IndexFile string `json:"-"`
+	// Tags are arbitrary user labels, e.g. for retention policies
+	Tags []string `json:"tags,omitempty"`
+	// Skew is the time between the earliest and the latest online blob snapshot.
+	// The closer it is to zero, the closer the backup is to being point-in-time
+	Skew time.Duration `json:"skew,omitempty"`
+	// Consistency records whether the blobs were modified while the online snapshot was being taken
+	Consistency *ConsistencyReport `json:"consistency,omitempty"`
 	// Blobs is the list of all blobs included in this backup
 	Blobs BlobList `json:"blobs"`
+	// Skipped lists the blobs that were deleted before they could be backed up
+	Skipped []string `json:"skipped,omitempty"`
+	// Partial is set if some blobs failed to back up
+	Partial bool `json:"partial,omitempty"`
+	// Failed lists the blobs that failed to back up, if the snapshot is partial
+	Failed []FailedBlob `json:"failed,omitempty"`
+}
+
+// FailedBlob describes a blob that failed to back up
+type FailedBlob struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	// CarriedForward is set if the blob's previous revision was included in the snapshot instead
+	CarriedForward bool `json:"carried_forward,omitempty"`
 }
 
 type BlobList []Blob
@@ -90,38 +116,52 @@ func (l *BlobList) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-func (s *Snapshot) save() error {
-	indexFile, err := os.Create(s.IndexFile)
+// assignID derives the snapshot ID from the index contents
+func (s *Snapshot) assignID() error {
+	s.ID = ""
+
+	data, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
-	defer indexFile.Close()
 
-	encoder := json.NewEncoder(indexFile)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(s)
+	s.ID = shortHash(data)
+	return nil
+}
+
+func shortHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8])
+}
+
+// marshal is the content of the snapshot's index object
+func (s *Snapshot) marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// TODO: Maybe do something with filebufs?
 
-	return nil
+	return append(data, '\n'), nil
 }
 
-func (s *Snapshot) load() error {
-	indexFile, err := os.Open(s.IndexFile)
+func (s *Snapshot) load(storage backend.Backend) error {
+	data, err := backend.ReadAll(storage, backend.KindIndex, s.IndexFile)
 	if err != nil {
 		return err
 	}
-	defer indexFile.Close()
 
-	decoder := json.NewDecoder(indexFile)
-	err = decoder.Decode(s)
+	err = json.Unmarshal(data, s)
 	if err != nil {
 		return err
 	}
 
+	if s.ID == "" {
+		// Snapshots predating IDs get one from their index as it was saved
+		s.ID = shortHash(data)
+	}
+
 	// TODO: Maybe do something with filebufs?
 
 	return nil
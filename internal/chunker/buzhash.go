@@ -0,0 +1,59 @@
+package chunker
+
+import (
+	"math/bits"
+)
+
+// buzhashWindow must not exceed the hash width: otherwise the bytes a hash width apart are rotated alike,
+// so equal ones cancel out
+const buzhashWindow = 64
+
+// buzhash implements a cyclic polynomial rolling hash over a fixed window
+type buzhash struct {
+	minSize int
+	maxSize int
+	mask    uint64
+}
+
+var buzhashTable [256]uint64
+
+func init() {
+	seed := splitmix64(0x62757a6861736800)
+	for i := range buzhashTable {
+		buzhashTable[i] = seed.next()
+	}
+}
+
+func newBuzhash(params Params) *buzhash {
+	return &buzhash{
+		minSize: int(params.MinSize),
+		maxSize: int(params.MaxSize),
+		mask:    uint64(1)<<params.avgBits() - 1,
+	}
+}
+
+func (b *buzhash) Cut(data []byte) int {
+	n := min(len(data), b.maxSize)
+	if n <= b.minSize {
+		return n
+	}
+
+	// Only the last window before minSize matters for the first possible boundary
+	start := max(b.minSize-buzhashWindow, 0)
+	hash := uint64(0)
+
+	for i := start; i < n; i++ {
+		hash = bits.RotateLeft64(hash, 1) ^ buzhashTable[data[i]]
+		if i-start >= buzhashWindow {
+			hash ^= bits.RotateLeft64(buzhashTable[data[i-buzhashWindow]], buzhashWindow)
+		}
+
+		if i+1 >= b.minSize && hash&b.mask == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+var _ Cutter = (*buzhash)(nil)
@@ -0,0 +1,196 @@
+package chunker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Algorithm identifies the rolling hash used to pick chunk boundaries
+type Algorithm string
+
+const (
+	// AlgorithmNone disables content-defined chunking: the input is split into pieces of NoneChunkSize
+	AlgorithmNone    Algorithm = "none"
+	AlgorithmRabin   Algorithm = "rabin"
+	AlgorithmFastCDC Algorithm = "fastcdc"
+	AlgorithmBuzhash Algorithm = "buzhash"
+)
+
+// Params configures a chunker. Note that changing any of these for an existing
+// repository breaks deduplication against the data already stored in it.
+type Params struct {
+	Algorithm Algorithm `json:"algorithm"`
+	// MinSize is the smallest chunk that may be produced (except for the last one)
+	MinSize uint32 `json:"min_size"`
+	// AvgSize is the desired average chunk size. Rounded down to a power of two
+	AvgSize uint32 `json:"avg_size"`
+	// MaxSize is the size after which a chunk is cut unconditionally
+	MaxSize uint32 `json:"max_size"`
+}
+
+// DefaultParams are the parameters used for new repositories
+func DefaultParams() Params {
+	return Params{
+		Algorithm: AlgorithmFastCDC,
+		MinSize:   256 * 1024,
+		AvgSize:   1024 * 1024,
+		MaxSize:   4 * 1024 * 1024,
+	}
+}
+
+func (p Params) Validate() error {
+	switch p.Algorithm {
+	case AlgorithmNone:
+		return nil
+	case AlgorithmRabin, AlgorithmFastCDC, AlgorithmBuzhash:
+	default:
+		return fmt.Errorf("unknown chunking algorithm: %q", p.Algorithm)
+	}
+
+	if p.MinSize == 0 || p.AvgSize == 0 || p.MaxSize == 0 {
+		return errors.New("chunk sizes must be positive")
+	}
+
+	if !(p.MinSize <= p.AvgSize && p.AvgSize <= p.MaxSize) {
+		return fmt.Errorf("invalid chunk sizes: want min <= avg <= max, got %v, %v, %v", p.MinSize, p.AvgSize, p.MaxSize)
+	}
+
+	return nil
+}
+
+// avgBits is the number of hash bits that have to be zero to get the desired average chunk size
+func (p Params) avgBits() int {
+	return bits.Len32(p.AvgSize) - 1
+}
+
+// Cutter finds chunk boundaries
+type Cutter interface {
+	// Cut returns the length of the first chunk in data.
+	// If no boundary is found, len(data) (capped at the maximum chunk size) is returned.
+	Cut(data []byte) int
+}
+
+// NewCutter constructs the Cutter for the given parameters.
+// Returns nil for AlgorithmNone.
+func NewCutter(params Params) (Cutter, error) {
+	err := params.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch params.Algorithm {
+	case AlgorithmRabin:
+		return newRabin(params), nil
+	case AlgorithmFastCDC:
+		return newGear(params), nil
+	case AlgorithmBuzhash:
+		return newBuzhash(params), nil
+	}
+
+	return nil, nil
+}
+
+// NoneChunkSize bounds the chunks without content-defined chunking, so that huge inputs needn't fit in memory.
+// Matches the largest range Azure checksums, so smaller blob ranges are still stored as a single chunk
+const NoneChunkSize = 4 * 1024 * 1024
+
+// Chunker splits a stream into content-defined chunks
+type Chunker struct {
+	reader io.Reader
+	cutter Cutter
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+func New(reader io.Reader, params Params) (*Chunker, error) {
+	cutter, err := NewCutter(params)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Chunker{
+		reader: reader,
+		cutter: cutter,
+	}
+
+	if cutter != nil {
+		result.buf = make([]byte, params.MaxSize)
+	}
+
+	return result, nil
+}
+
+// Next returns the next chunk, or io.EOF once the input is exhausted.
+// The returned slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.cutter == nil {
+		if c.eof {
+			return nil, io.EOF
+		}
+
+		data, err := io.ReadAll(io.LimitReader(c.reader, NoneChunkSize))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < NoneChunkSize {
+			c.eof = true
+		}
+		if len(data) == 0 {
+			return nil, io.EOF
+		}
+
+		return data, nil
+	}
+
+	err := c.fill()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cutter.Cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+
+	return chunk, nil
+}
+
+// fill makes sure the buffer holds a full max-sized window unless the input is exhausted
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start == len(c.buf) {
+		return nil
+	}
+
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	n, err := io.ReadFull(c.reader, c.buf[c.end:])
+	c.end += n
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		c.eof = true
+		return nil
+	}
+
+	return err
+}
+
+// splitmix64 is a tiny deterministic generator used to fill the hash tables.
+// The seeds must never change, or previously stored chunks will stop deduplicating.
+type splitmix64 uint64
+
+func (s *splitmix64) next() uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
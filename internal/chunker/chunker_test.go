@@ -0,0 +1,189 @@
+package chunker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+)
+
+func randomData(size int, seed uint64) []byte {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	return data
+}
+
+func split(t *testing.T, data []byte, params Params) [][]byte {
+	t.Helper()
+
+	chunker, err := New(bytes.NewReader(data), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+// boundaries returns the end offsets of the chunks
+func boundaries(chunks [][]byte) map[int]bool {
+	result := map[int]bool{}
+	offset := 0
+	for _, chunk := range chunks {
+		offset += len(chunk)
+		result[offset] = true
+	}
+	return result
+}
+
+func smallParams(algorithm Algorithm) Params {
+	return Params{
+		Algorithm: algorithm,
+		MinSize:   2 * 1024,
+		AvgSize:   8 * 1024,
+		MaxSize:   32 * 1024,
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(1024*1024, 1)
+
+	tests := []struct {
+		name   string
+		params Params
+	}{
+		{"rabin", smallParams(AlgorithmRabin)},
+		{"fastcdc", smallParams(AlgorithmFastCDC)},
+		{"buzhash", smallParams(AlgorithmBuzhash)},
+		{"none", Params{Algorithm: AlgorithmNone}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := split(t, data, test.params)
+
+			if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+				t.Fatalf("chunks don't add up to the input: got %v bytes, want %v", len(joined), len(data))
+			}
+
+			if test.params.Algorithm == AlgorithmNone {
+				return
+			}
+
+			for i, chunk := range chunks {
+				if len(chunk) > int(test.params.MaxSize) {
+					t.Errorf("chunk %v is %v bytes, above the maximum", i, len(chunk))
+				}
+				if len(chunk) < int(test.params.MinSize) && i != len(chunks)-1 {
+					t.Errorf("chunk %v is %v bytes, below the minimum", i, len(chunk))
+				}
+			}
+
+			again := split(t, data, test.params)
+			if len(again) != len(chunks) {
+				t.Fatalf("chunking isn't deterministic: got %v chunks, then %v", len(chunks), len(again))
+			}
+		})
+	}
+}
+
+// TestBoundaryStability checks that an insertion only moves the boundaries near it,
+// which is what makes content-defined chunking deduplicate shifted data
+func TestBoundaryStability(t *testing.T) {
+	data := randomData(1024*1024, 2)
+	const insertAt = 100 * 1024
+	inserted := randomData(100, 3)
+
+	shifted := make([]byte, 0, len(data)+len(inserted))
+	shifted = append(shifted, data[:insertAt]...)
+	shifted = append(shifted, inserted...)
+	shifted = append(shifted, data[insertAt:]...)
+
+	for _, algorithm := range []Algorithm{AlgorithmRabin, AlgorithmFastCDC, AlgorithmBuzhash} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			params := smallParams(algorithm)
+			original := boundaries(split(t, data, params))
+			moved := boundaries(split(t, shifted, params))
+
+			// Past the insertion (with some slack to resynchronize), every boundary should just shift
+			total, kept := 0, 0
+			for offset := range original {
+				if offset < insertAt+int(params.MaxSize) {
+					continue
+				}
+				total++
+				if moved[offset+len(inserted)] {
+					kept++
+				}
+			}
+
+			if total == 0 {
+				t.Fatal("no boundaries found past the insertion")
+			}
+			if kept != total {
+				t.Errorf("only %v of %v boundaries past the insertion survived it", kept, total)
+			}
+		})
+	}
+}
+
+// TestPeriodicInput checks that repeating data isn't cut at every opportunity,
+// as happens when the bytes a period apart cancel out in the rolling hash
+func TestPeriodicInput(t *testing.T) {
+	data := bytes.Repeat(randomData(32, 4), 32*1024)
+
+	for _, algorithm := range []Algorithm{AlgorithmRabin, AlgorithmFastCDC, AlgorithmBuzhash} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			params := smallParams(algorithm)
+			chunks := split(t, data, params)
+
+			short := 0
+			for _, chunk := range chunks {
+				if len(chunk) == int(params.MinSize) {
+					short++
+				}
+			}
+
+			if short > len(chunks)/2 {
+				t.Errorf("%v of %v chunks are cut at the minimum size", short, len(chunks))
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		params Params
+		valid  bool
+	}{
+		{"default", DefaultParams(), true},
+		{"none", Params{Algorithm: AlgorithmNone}, true},
+		{"unknown algorithm", Params{Algorithm: "zstd", MinSize: 1, AvgSize: 2, MaxSize: 3}, false},
+		{"zero size", Params{Algorithm: AlgorithmRabin, MinSize: 0, AvgSize: 2, MaxSize: 3}, false},
+		{"min above avg", Params{Algorithm: AlgorithmRabin, MinSize: 4, AvgSize: 2, MaxSize: 8}, false},
+		{"avg above max", Params{Algorithm: AlgorithmRabin, MinSize: 1, AvgSize: 16, MaxSize: 8}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.params.Validate()
+			if (err == nil) != test.valid {
+				t.Errorf("Validate() = %v, want valid = %v", err, test.valid)
+			}
+		})
+	}
+}
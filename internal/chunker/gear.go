@@ -0,0 +1,68 @@
+package chunker
+
+// gear implements FastCDC: a Gear rolling hash with normalized chunking
+type gear struct {
+	minSize int
+	avgSize int
+	maxSize int
+	// maskS is used before the average size is reached (harder to match),
+	// maskL afterwards (easier to match). This narrows the chunk size distribution.
+	maskS uint64
+	maskL uint64
+}
+
+var gearTable [256]uint64
+
+func init() {
+	seed := splitmix64(0x6765617263646300)
+	for i := range gearTable {
+		gearTable[i] = seed.next()
+	}
+}
+
+func newGear(params Params) *gear {
+	avgBits := params.avgBits()
+
+	return &gear{
+		minSize: int(params.MinSize),
+		avgSize: int(params.AvgSize),
+		maxSize: int(params.MaxSize),
+		maskS:   topBitsMask(avgBits + 2),
+		maskL:   topBitsMask(max(avgBits-2, 1)),
+	}
+}
+
+// topBitsMask selects the n most significant bits.
+// Gear shifts the hash left, so the top bits depend on the most bytes.
+func topBitsMask(n int) uint64 {
+	return ^uint64(0) << (64 - min(n, 64))
+}
+
+func (g *gear) Cut(data []byte) int {
+	n := min(len(data), g.maxSize)
+	if n <= g.minSize {
+		return n
+	}
+
+	normal := min(g.avgSize, n)
+	hash := uint64(0)
+	i := g.minSize
+
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&g.maskS == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&g.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+var _ Cutter = (*gear)(nil)
@@ -0,0 +1,94 @@
+package chunker
+
+import (
+	"math/bits"
+)
+
+const rabinWindow = 64
+
+// rabinPolynomial is an irreducible polynomial of degree 53 over GF(2)
+const rabinPolynomial pol = 0x3DA3358B4DC173
+
+// pol is a polynomial over GF(2), one bit per coefficient
+type pol uint64
+
+func (p pol) deg() int {
+	return bits.Len64(uint64(p)) - 1
+}
+
+func (p pol) mod(d pol) pol {
+	for p.deg() >= d.deg() {
+		p ^= d << (p.deg() - d.deg())
+	}
+
+	return p
+}
+
+var rabinTables struct {
+	// out[b] is the fingerprint of b followed by rabinWindow-1 zero bytes.
+	// Adding it removes b from the front of the window.
+	out [256]pol
+	// mod[b] reduces a fingerprint whose top byte (above the polynomial degree) is b
+	mod [256]pol
+}
+
+func init() {
+	degree := rabinPolynomial.deg()
+
+	for b := range 256 {
+		h := appendByte(0, byte(b))
+		for range rabinWindow - 1 {
+			h = appendByte(h, 0)
+		}
+		rabinTables.out[b] = h
+
+		rabinTables.mod[b] = (pol(b) << degree).mod(rabinPolynomial) | (pol(b) << degree)
+	}
+}
+
+func appendByte(h pol, b byte) pol {
+	return (h<<8 | pol(b)).mod(rabinPolynomial)
+}
+
+// rabin implements Rabin fingerprinting over a fixed window
+type rabin struct {
+	minSize int
+	maxSize int
+	mask    pol
+}
+
+func newRabin(params Params) *rabin {
+	return &rabin{
+		minSize: int(params.MinSize),
+		maxSize: int(params.MaxSize),
+		mask:    pol(1)<<params.avgBits() - 1,
+	}
+}
+
+func (r *rabin) Cut(data []byte) int {
+	n := min(len(data), r.maxSize)
+	if n <= r.minSize {
+		return n
+	}
+
+	shift := rabinPolynomial.deg() - 8
+	start := max(r.minSize-rabinWindow, 0)
+	digest := pol(0)
+
+	for i := start; i < n; i++ {
+		if i-start >= rabinWindow {
+			digest ^= rabinTables.out[data[i-rabinWindow]]
+		}
+
+		top := byte(digest >> shift)
+		digest = (digest<<8 | pol(data[i])) ^ rabinTables.mod[top]
+
+		if i+1 >= r.minSize && digest&r.mask == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+var _ Cutter = (*rabin)(nil)
@@ -5,7 +5,19 @@ import (
 )
 
 var (
-	ErrNoSnapshots = new("no snapshots made in this repository")
+	ErrNoSnapshots         = new("no snapshots made in this repository")
+	ErrSnapshotNotFound    = new("snapshot not found")
+	ErrAmbiguousSnapshot   = new("snapshot reference is ambiguous")
+	ErrRepositoryEncrypted = new("repository is encrypted, but no passphrase or key file was provided")
+	ErrWrongKey            = new("wrong passphrase or key file")
+	ErrRepositoryLocked    = new("repository is locked by another process")
+	ErrLockLost            = new("the repository lock was lost")
+	ErrProtected           = new("the repository is protected from deletion")
+	ErrArchived            = new("the repository data is archived and has to be rehydrated first")
+	ErrCheckFailed         = new("repository check found errors")
+	ErrPartialBackup       = new("some blobs failed to back up, the snapshot is partial")
+	ErrInterruptedBackup   = new("an interrupted backup exists, resume or abort it first")
+	ErrNoInterruptedBackup = new("no interrupted backup to resume or abort")
 )
 
 func new(desc string) error {
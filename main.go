@@ -16,6 +16,7 @@ func main() {
 
 	err = app.MakeCmdRoot(filepath.Base(appName)).Execute()
 	if err != nil {
-		log.Fatalf("Error: %v", err)
+		log.Printf("Error: %v", err)
+		os.Exit(app.ExitCode(err))
 	}
 }